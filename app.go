@@ -0,0 +1,134 @@
+package leaf
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/shinjuwu/leaf/cluster"
+	"github.com/shinjuwu/leaf/conf"
+	"github.com/shinjuwu/leaf/console"
+	"github.com/shinjuwu/leaf/module"
+)
+
+// an App owns its modules, console and cluster,
+// several apps can run in one process
+type App struct {
+	ConsolePort     int
+	ConsolePrompt   string
+	NodeID          string
+	ListenAddr      string
+	ConnAddrs       []string
+	PendingWriteNum int
+	modules         *module.Manager
+	console         *console.Console
+	cluster         *cluster.Cluster
+	stopOnce        sync.Once
+	stopErr         error
+	done            chan struct{}
+}
+
+// the new app is configured by conf
+func NewApp() *App {
+	c := console.New()
+	return newApp(module.NewManager(c), c, cluster.New())
+}
+
+func newApp(modules *module.Manager, console *console.Console, cluster *cluster.Cluster) *App {
+	app := new(App)
+	app.ConsolePort = conf.ConsolePort
+	app.ConsolePrompt = conf.ConsolePrompt
+	app.NodeID = conf.NodeID
+	app.ListenAddr = conf.ListenAddr
+	app.ConnAddrs = conf.ConnAddrs
+	app.PendingWriteNum = conf.PendingWriteNum
+	app.modules = modules
+	app.console = console
+	app.cluster = cluster
+	app.done = make(chan struct{})
+	return app
+}
+
+// modules registered by name, see module.Manager.RegisterNamed,
+// are started along with the modules passed to Start
+func (app *App) Modules() *module.Manager {
+	return app.modules
+}
+
+func (app *App) Console() *console.Console {
+	return app.console
+}
+
+func (app *App) Cluster() *cluster.Cluster {
+	return app.cluster
+}
+
+func (app *App) Start(mods ...module.Module) error {
+	app.console.Port = app.ConsolePort
+	app.console.Prompt = app.ConsolePrompt
+	app.cluster.NodeID = app.NodeID
+	app.cluster.ListenAddr = app.ListenAddr
+	app.cluster.ConnAddrs = app.ConnAddrs
+	app.cluster.PendingWriteNum = app.PendingWriteNum
+
+	// module
+	for i := 0; i < len(mods); i++ {
+		app.modules.Register(mods[i])
+	}
+	if err := app.modules.Init(); err != nil {
+		return err
+	}
+
+	// cluster
+	app.cluster.Init()
+
+	// console
+	app.console.Init()
+
+	return nil
+}
+
+// Stop shuts the app down in stages, ctx bounds the whole shutdown.
+// every stage runs even if the former ones fail, and the modules are
+// destroyed within conf.DestroyTimeout even if ctx is done.
+// the errors of the stages are combined, a second Stop returns them again.
+// Wait returns once Stop is done
+func (app *App) Stop(ctx context.Context) error {
+	app.stopOnce.Do(func() {
+		defer close(app.done)
+
+		var errs []string
+		check := func(err error) {
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+
+		// stop accepting connections
+		app.cluster.Stop()
+		check(app.modules.Stop(ctx))
+
+		// notify connected clients
+		check(app.modules.Notify(ctx))
+
+		// drain chanrpc queues
+		check(app.modules.Drain(ctx))
+
+		app.console.Destroy()
+		app.cluster.Destroy()
+		if ctx.Err() != nil {
+			ctx = context.Background()
+		}
+		check(app.modules.Destroy(ctx))
+
+		if len(errs) > 0 {
+			app.stopErr = errors.New(strings.Join(errs, "; "))
+		}
+	})
+	return app.stopErr
+}
+
+func (app *App) Wait() {
+	<-app.done
+}
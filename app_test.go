@@ -0,0 +1,110 @@
+package leaf_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shinjuwu/leaf"
+	"github.com/shinjuwu/leaf/chanrpc"
+	"github.com/shinjuwu/leaf/module"
+)
+
+type counter struct {
+	*module.Skeleton
+	n         int
+	stuck     bool
+	destroyed chan bool
+}
+
+func newCounter() *counter {
+	m := new(counter)
+	m.Skeleton = &module.Skeleton{
+		Name:          "counter",
+		ChanRPCServer: chanrpc.NewServer(10),
+	}
+	m.destroyed = make(chan bool)
+	return m
+}
+
+func (m *counter) OnInit() {
+	m.Skeleton.Init()
+	m.RegisterChanRPC("add", func(args []interface{}) interface{} {
+		m.n += args[0].(int)
+		return m.n
+	})
+}
+
+func (m *counter) OnDestroy() {
+	close(m.destroyed)
+}
+
+func (m *counter) Drain(ctx context.Context) error {
+	if m.stuck {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return m.Skeleton.Drain(ctx)
+}
+
+func TestApp(t *testing.T) {
+	// two apps in one process
+	m1, m2 := newCounter(), newCounter()
+	app1, app2 := leaf.NewApp(), leaf.NewApp()
+	if err := app1.Start(m1); err != nil {
+		t.Fatal(err)
+	}
+	if err := app2.Start(m2); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		m1.ChanRPCServer.Call1("add", i)
+	}
+	if n, err := m2.ChanRPCServer.Call1("add", 10); n != 10 || err != nil {
+		t.Fatalf("add: %v %v", n, err)
+	}
+	if n, err := m1.ChanRPCServer.Call1("add", 0); n != 6 || err != nil {
+		t.Fatalf("add: %v %v", n, err)
+	}
+
+	for _, app := range []*leaf.App{app1, app2} {
+		go app.Stop(context.Background())
+		app.Wait()
+	}
+	for _, m := range []*counter{m1, m2} {
+		select {
+		case <-m.destroyed:
+		default:
+			t.Error("module not destroyed")
+		}
+	}
+}
+
+func TestAppStopTimeout(t *testing.T) {
+	m := newCounter()
+	m.stuck = true
+	app := leaf.NewApp()
+	if err := app.Start(m); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := app.Stop(ctx)
+	if err == nil || !strings.Contains(err.Error(), "drain stage") {
+		t.Fatalf("error %v", err)
+	}
+	app.Wait()
+
+	// the modules are destroyed anyway
+	select {
+	case <-m.destroyed:
+	default:
+		t.Error("module not destroyed")
+	}
+	if err2 := app.Stop(context.Background()); err2 != err {
+		t.Errorf("second stop: %v", err2)
+	}
+}
@@ -1,13 +1,20 @@
 package chanrpc
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/shinjuwu/leaf/conf"
 	"github.com/shinjuwu/leaf/log"
+	"github.com/shinjuwu/leaf/timer"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var ErrTimeout = errors.New("chanrpc call timeout")
+
 // one server per goroutine (goroutine not safe)
 // one client per goroutine (goroutine not safe)
 type Server struct {
@@ -17,17 +24,53 @@ type Server struct {
 	// func(args []interface{})
 	// func(args []interface{}) interface{}
 	// func(args []interface{}) []interface{}
-	functions map[interface{}]interface{}
-	ChanCall  chan *CallInfo
+	functions        map[interface{}]interface{}
+	mutexFunctions   sync.RWMutex
+	ChanCall         chan *CallInfo
+	ChanPriorityCall chan *CallInfo
+	interceptors     []Interceptor
+	mutexStats       sync.Mutex
+	stats            map[interface{}]*FuncStat
+	dropPolicy       DropPolicy
+	dropped          [numDropReason]uint64
+	recorder         atomic.Value
+	priority         int32
 }
 
+// Handler executes a call and returns its result
+type Handler func(args []interface{}) (interface{}, error)
+
+// Interceptor wraps the execution of a call. It may inspect the id and the
+// args, invoke next to continue the chain and inspect the result, or
+// short-circuit the call by returning without invoking next. A panic of the
+// function is returned by next as an error
+type Interceptor func(id interface{}, args []interface{}, next Handler) (interface{}, error)
+
 type CallInfo struct {
+	id      interface{}
 	f       interface{}
 	args    []interface{}
 	chanRet chan *RetInfo
 	cb      interface{}
+	// callPending, callReplied or callAbandoned
+	state int32
+	// timeout of an asynchronous call
+	t *timer.Timer
+	// calls such as Flush skip the interceptors, the stats and the recorder
+	internal bool
 }
 
+// the function id of the call
+func (ci *CallInfo) ID() interface{} {
+	return ci.id
+}
+
+const (
+	callPending = iota
+	callReplied
+	callAbandoned
+)
+
 type RetInfo struct {
 	// nil
 	// interface{}
@@ -39,19 +82,25 @@ type RetInfo struct {
 	// func(ret interface{}, err error)
 	// func(ret []interface{}, err error)
 	cb interface{}
+	t  *timer.Timer
 }
 
 type Client struct {
 	s               *Server
 	chanSyncRet     chan *RetInfo
 	ChanAsynRet     chan *RetInfo
-	pendingAsynCall int
+	pendingAsynCall int32
+	priority        bool
+	timeout         time.Duration
+	dispatcher      *timer.Dispatcher
 }
 
 func NewServer(l int) *Server {
 	s := new(Server)
 	s.functions = make(map[interface{}]interface{})
+	s.stats = make(map[interface{}]*FuncStat)
 	s.ChanCall = make(chan *CallInfo, l)
+	s.ChanPriorityCall = make(chan *CallInfo, l)
 	return s
 }
 
@@ -63,7 +112,7 @@ func assert(i interface{}) []interface{} {
 	}
 }
 
-// you must call the function before calling Open and Go
+// goroutine safe
 func (s *Server) Register(id interface{}, f interface{}) {
 	switch f.(type) {
 	case func([]interface{}):
@@ -73,6 +122,13 @@ func (s *Server) Register(id interface{}, f interface{}) {
 		panic(fmt.Sprintf("function id %v: definition of function is invalid", id))
 	}
 
+	s.register(id, f)
+}
+
+func (s *Server) register(id interface{}, f interface{}) {
+	s.mutexFunctions.Lock()
+	defer s.mutexFunctions.Unlock()
+
 	if _, ok := s.functions[id]; ok {
 		panic(fmt.Sprintf("function id %v: already registered", id))
 	}
@@ -80,10 +136,34 @@ func (s *Server) Register(id interface{}, f interface{}) {
 	s.functions[id] = f
 }
 
+// goroutine safe
+func (s *Server) Unregister(id interface{}) {
+	s.mutexFunctions.Lock()
+	delete(s.functions, id)
+	s.mutexFunctions.Unlock()
+}
+
+func (s *Server) function(id interface{}) interface{} {
+	s.mutexFunctions.RLock()
+	defer s.mutexFunctions.RUnlock()
+
+	return s.functions[id]
+}
+
+// interceptors run in registration order, the first one is the outermost
+// you must call the function before calling Open and Go
+func (s *Server) AddInterceptor(i Interceptor) {
+	s.interceptors = append(s.interceptors, i)
+}
+
 func (s *Server) ret(ci *CallInfo, ri *RetInfo) (err error) {
 	if ci.chanRet == nil {
 		return
 	}
+	// the caller has given up waiting, drop the reply
+	if !atomic.CompareAndSwapInt32(&ci.state, callPending, callReplied) {
+		return
+	}
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -92,39 +172,149 @@ func (s *Server) ret(ci *CallInfo, ri *RetInfo) (err error) {
 	}()
 
 	ri.cb = ci.cb
+	ri.t = ci.t
 	ci.chanRet <- ri
 	return
 }
 
+func panicError(r interface{}) error {
+	if conf.LenStackBuf > 0 {
+		buf := make([]byte, conf.LenStackBuf)
+		l := runtime.Stack(buf, false)
+		return fmt.Errorf("%v: %s", r, buf[:l])
+	} else {
+		return fmt.Errorf("%v", r)
+	}
+}
+
+func call(f interface{}, args []interface{}) (interface{}, error) {
+	switch f.(type) {
+	case func([]interface{}):
+		f.(func([]interface{}))(args)
+		return nil, nil
+	case func([]interface{}) interface{}:
+		return f.(func([]interface{}) interface{})(args), nil
+	case func([]interface{}) []interface{}:
+		return f.(func([]interface{}) []interface{})(args), nil
+	case *typedFunc:
+		return f.(*typedFunc).call(args)
+	}
+
+	panic("bug")
+}
+
+// 0: Call0, 1: Call1, 2: CallN
+func kind(f interface{}) int {
+	switch f.(type) {
+	case func([]interface{}):
+		return 0
+	case func([]interface{}) interface{}:
+		return 1
+	case func([]interface{}) []interface{}:
+		return 2
+	case *typedFunc:
+		return f.(*typedFunc).n()
+	}
+
+	panic("bug")
+}
+
+func intercept(i Interceptor, id interface{}, next Handler) Handler {
+	return func(args []interface{}) (interface{}, error) {
+		return i(id, args, next)
+	}
+}
+
 func (s *Server) exec(ci *CallInfo) (err error) {
+	// the caller has given up waiting, skip the call
+	if atomic.LoadInt32(&ci.state) == callAbandoned {
+		return
+	}
+	if ci.internal {
+		ret, err := call(ci.f, ci.args)
+		return s.ret(ci, &RetInfo{ret: ret, err: err})
+	}
+
+	var (
+		callErr  error
+		panicked bool
+		start    = time.Now()
+		record   []byte
+	)
+	recorder := s.getRecorder()
+	if recorder != nil {
+		var encErr error
+		record, encErr = recorder.enc.Encode(ci.id, ci.args)
+		if encErr != nil {
+			log.Error("function id %v: record error: %v", ci.id, encErr)
+			recorder = nil
+		}
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
-			if conf.LenStackBuf > 0 {
-				buf := make([]byte, conf.LenStackBuf)
-				l := runtime.Stack(buf, false)
-				err = fmt.Errorf("%v: %s", r, buf[:l])
-			} else {
-				err = fmt.Errorf("%v", r)
-			}
-
+			panicked = true
+			err = panicError(r)
 			s.ret(ci, &RetInfo{err: fmt.Errorf("%v", r)})
 		}
+
+		elapsed := time.Since(start)
+		s.record(ci.id, elapsed, callErr != nil || panicked, panicked)
+		if recorder != nil {
+			recorder.write(start, elapsed, record)
+		}
 	}()
 
 	// execute
-	switch ci.f.(type) {
-	case func([]interface{}):
-		ci.f.(func([]interface{}))(ci.args)
-		return s.ret(ci, &RetInfo{})
-	case func([]interface{}) interface{}:
-		ret := ci.f.(func([]interface{}) interface{})(ci.args)
-		return s.ret(ci, &RetInfo{ret: ret})
-	case func([]interface{}) []interface{}:
-		ret := ci.f.(func([]interface{}) []interface{})(ci.args)
-		return s.ret(ci, &RetInfo{ret: ret})
+	if len(s.interceptors) == 0 {
+		var ret interface{}
+		ret, callErr = call(ci.f, ci.args)
+		return s.ret(ci, &RetInfo{ret: ret, err: callErr})
 	}
 
-	panic("bug")
+	var perr error
+	h := Handler(func(args []interface{}) (ret interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				perr = panicError(r)
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+
+		return call(ci.f, args)
+	})
+	for i := len(s.interceptors) - 1; i >= 0; i-- {
+		h = intercept(s.interceptors[i], ci.id, h)
+	}
+
+	var ret interface{}
+	ret, callErr = h(ci.args)
+	err = s.ret(ci, &RetInfo{ret: ret, err: callErr})
+	if perr != nil {
+		panicked = true
+		err = perr
+	}
+	return
+}
+
+// Invoke executes the function on the calling goroutine,
+// which must own the server
+func (s *Server) Invoke(id interface{}, args ...interface{}) (interface{}, error) {
+	f := s.function(id)
+	if f == nil {
+		return nil, fmt.Errorf("function id %v: function not registered", id)
+	}
+
+	ci := &CallInfo{
+		id:      id,
+		f:       f,
+		args:    args,
+		chanRet: make(chan *RetInfo, 1),
+	}
+	s.Exec(ci)
+
+	ri := <-ci.chanRet
+	return ri.ret, ri.err
 }
 
 func (s *Server) Exec(ci *CallInfo) {
@@ -136,19 +326,58 @@ func (s *Server) Exec(ci *CallInfo) {
 
 // goroutine safe
 func (s *Server) Go(id interface{}, args ...interface{}) {
-	f := s.functions[id]
+	s.goCall(s.ChanCall, id, args)
+}
+
+// goroutine safe
+// the call is queued in ChanPriorityCall, or in ChanCall
+// unless the priority lane is enabled
+func (s *Server) GoPriority(id interface{}, args ...interface{}) {
+	s.goCall(s.chanPriorityCall(), id, args)
+}
+
+// EnablePriority tells that the goroutine of the server drains
+// ChanPriorityCall before ChanCall, as Skeleton.Run does.
+// goroutine safe
+func (s *Server) EnablePriority() {
+	atomic.StoreInt32(&s.priority, 1)
+}
+
+func (s *Server) chanPriorityCall() chan *CallInfo {
+	if atomic.LoadInt32(&s.priority) == 0 {
+		return s.ChanCall
+	}
+	return s.ChanPriorityCall
+}
+
+func (s *Server) goCall(chanCall chan *CallInfo, id interface{}, args []interface{}) {
+	f := s.function(id)
 	if f == nil {
+		s.drop(DropUnregistered, id, args)
 		return
 	}
 
+	// ChanCall closed
 	defer func() {
-		recover()
+		if r := recover(); r != nil {
+			s.drop(DropClosed, id, args)
+		}
 	}()
 
-	s.ChanCall <- &CallInfo{
+	ci := &CallInfo{
+		id:   id,
 		f:    f,
 		args: args,
 	}
+	if s.dropPolicy.NonBlocking {
+		select {
+		case chanCall <- ci:
+		default:
+			s.drop(DropFull, id, args)
+		}
+	} else {
+		chanCall <- ci
+	}
 }
 
 // goroutine safe
@@ -166,9 +395,55 @@ func (s *Server) CallN(id interface{}, args ...interface{}) ([]interface{}, erro
 	return s.Open(0).CallN(id, args...)
 }
 
+// goroutine safe
+func (s *Server) Call0Ctx(ctx context.Context, id interface{}, args ...interface{}) error {
+	return s.Open(0).Call0Ctx(ctx, id, args...)
+}
+
+// goroutine safe
+func (s *Server) Call1Ctx(ctx context.Context, id interface{}, args ...interface{}) (interface{}, error) {
+	return s.Open(0).Call1Ctx(ctx, id, args...)
+}
+
+// goroutine safe
+func (s *Server) CallNCtx(ctx context.Context, id interface{}, args ...interface{}) ([]interface{}, error) {
+	return s.Open(0).CallNCtx(ctx, id, args...)
+}
+
+// goroutine safe
+// Call1Ctx through ChanPriorityCall
+func (s *Server) CallPriority(ctx context.Context, id interface{}, args ...interface{}) (interface{}, error) {
+	c := s.Open(0)
+	c.SetPriority(true)
+	return c.Call1Ctx(ctx, id, args...)
+}
+
+// goroutine safe
+// Flush returns once the calls queued in ChanCall before it are executed
+func (s *Server) Flush(ctx context.Context) error {
+	c := s.Open(0)
+	ci := &CallInfo{
+		f:        func([]interface{}) {},
+		chanRet:  c.chanSyncRet,
+		internal: true,
+	}
+	err := c.call(ctx, ci, true)
+	if err != nil {
+		return err
+	}
+
+	return c.wait(ctx, ci).err
+}
+
 func (s *Server) Close() {
+	close(s.ChanPriorityCall)
 	close(s.ChanCall)
 
+	for ci := range s.ChanPriorityCall {
+		s.ret(ci, &RetInfo{
+			err: errors.New("chanrpc server closed"),
+		})
+	}
 	for ci := range s.ChanCall {
 		s.ret(ci, &RetInfo{
 			err: errors.New("chanrpc server closed"),
@@ -176,6 +451,14 @@ func (s *Server) Close() {
 	}
 }
 
+// a closed server is usable again, the registered functions are kept.
+// you must call the function before the goroutine of the server runs again
+// and while no call is sent to the server
+func (s *Server) Reopen() {
+	s.ChanCall = make(chan *CallInfo, cap(s.ChanCall))
+	s.ChanPriorityCall = make(chan *CallInfo, cap(s.ChanPriorityCall))
+}
+
 // goroutine safe
 func (s *Server) Open(l int) *Client {
 	c := NewClient(l)
@@ -194,18 +477,41 @@ func (c *Client) Attach(s *Server) {
 	c.s = s
 }
 
-func (c *Client) call(ci *CallInfo, block bool) (err error) {
+// the calls of the client are queued in ChanPriorityCall if the server
+// enables its priority lane, in ChanCall otherwise
+func (c *Client) SetPriority(priority bool) {
+	c.priority = priority
+}
+
+// the timeouts of asynchronous calls are dispatched by disp, so the
+// callback of a timed out call runs on the goroutine that owns disp.
+// d is the default timeout, 0 means no timeout
+func (c *Client) SetTimeout(disp *timer.Dispatcher, d time.Duration) {
+	c.dispatcher = disp
+	c.timeout = d
+}
+
+func (c *Client) call(ctx context.Context, ci *CallInfo, block bool) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = r.(error)
 		}
 	}()
 
+	chanCall := c.s.ChanCall
+	if c.priority {
+		chanCall = c.s.chanPriorityCall()
+	}
+
 	if block {
-		c.s.ChanCall <- ci
+		select {
+		case chanCall <- ci:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
 	} else {
 		select {
-		case c.s.ChanCall <- ci:
+		case chanCall <- ci:
 		default:
 			err = errors.New("chanrpc channel full")
 		}
@@ -219,110 +525,160 @@ func (c *Client) f(id interface{}, n int) (f interface{}, err error) {
 		return
 	}
 
-	f = c.s.functions[id]
+	f = c.s.function(id)
 	if f == nil {
 		err = fmt.Errorf("function id %v: function not registered", id)
 		return
 	}
 
-	var ok bool
-	switch n {
-	case 0:
-		_, ok = f.(func([]interface{}))
-	case 1:
-		_, ok = f.(func([]interface{}) interface{})
-	case 2:
-		_, ok = f.(func([]interface{}) []interface{})
-	default:
-		panic("bug")
-	}
-
-	if !ok {
+	if kind(f) != n {
 		err = fmt.Errorf("function id %v: return type mismatch", id)
 	}
 	return
 }
 
+// wait for the reply of a synchronous call, the call is abandoned
+// if ctx is done before the server has replied
+func (c *Client) wait(ctx context.Context, ci *CallInfo) *RetInfo {
+	select {
+	case ri := <-c.chanSyncRet:
+		return ri
+	case <-ctx.Done():
+		if atomic.CompareAndSwapInt32(&ci.state, callPending, callAbandoned) {
+			return &RetInfo{err: ctx.Err()}
+		}
+		// the reply is already on its way
+		return <-c.chanSyncRet
+	}
+}
+
 func (c *Client) Call0(id interface{}, args ...interface{}) error {
+	return c.Call0Ctx(context.Background(), id, args...)
+}
+
+func (c *Client) Call1(id interface{}, args ...interface{}) (interface{}, error) {
+	return c.Call1Ctx(context.Background(), id, args...)
+}
+
+func (c *Client) CallN(id interface{}, args ...interface{}) ([]interface{}, error) {
+	return c.CallNCtx(context.Background(), id, args...)
+}
+
+// the call returns ctx.Err() if ctx is done before the server has replied,
+// a late reply is dropped
+func (c *Client) Call0Ctx(ctx context.Context, id interface{}, args ...interface{}) error {
 	f, err := c.f(id, 0)
 	if err != nil {
 		return err
 	}
 
-	err = c.call(&CallInfo{
+	ci := &CallInfo{
+		id:      id,
 		f:       f,
 		args:    args,
 		chanRet: c.chanSyncRet,
-	}, true)
+	}
+	err = c.call(ctx, ci, true)
 	if err != nil {
 		return err
 	}
 
-	ri := <-c.chanSyncRet
+	ri := c.wait(ctx, ci)
 	return ri.err
 }
 
-func (c *Client) Call1(id interface{}, args ...interface{}) (interface{}, error) {
+func (c *Client) Call1Ctx(ctx context.Context, id interface{}, args ...interface{}) (interface{}, error) {
 	f, err := c.f(id, 1)
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.call(&CallInfo{
+	ci := &CallInfo{
+		id:      id,
 		f:       f,
 		args:    args,
 		chanRet: c.chanSyncRet,
-	}, true)
+	}
+	err = c.call(ctx, ci, true)
 	if err != nil {
 		return nil, err
 	}
 
-	ri := <-c.chanSyncRet
+	ri := c.wait(ctx, ci)
 	return ri.ret, ri.err
 }
 
-func (c *Client) CallN(id interface{}, args ...interface{}) ([]interface{}, error) {
+func (c *Client) CallNCtx(ctx context.Context, id interface{}, args ...interface{}) ([]interface{}, error) {
 	f, err := c.f(id, 2)
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.call(&CallInfo{
+	ci := &CallInfo{
+		id:      id,
 		f:       f,
 		args:    args,
 		chanRet: c.chanSyncRet,
-	}, true)
+	}
+	err = c.call(ctx, ci, true)
 	if err != nil {
 		return nil, err
 	}
 
-	ri := <-c.chanSyncRet
+	ri := c.wait(ctx, ci)
 	return assert(ri.ret), ri.err
 }
 
-func (c *Client) asynCall(id interface{}, args []interface{}, cb interface{}, n int) {
+func (c *Client) asynCall(id interface{}, args []interface{}, cb interface{}, n int, d time.Duration) {
 	f, err := c.f(id, n)
 	if err != nil {
 		c.ChanAsynRet <- &RetInfo{err: err, cb: cb}
 		return
 	}
 
-	err = c.call(&CallInfo{
+	ci := &CallInfo{
+		id:      id,
 		f:       f,
 		args:    args,
 		chanRet: c.ChanAsynRet,
 		cb:      cb,
-	}, false)
+	}
+	if d > 0 {
+		ci.t = c.dispatcher.AfterFunc(d, func() {
+			if atomic.CompareAndSwapInt32(&ci.state, callPending, callAbandoned) {
+				atomic.AddInt32(&c.pendingAsynCall, -1)
+				execCb(&RetInfo{err: ErrTimeout, cb: cb})
+			}
+		})
+	}
+
+	err = c.call(context.Background(), ci, false)
 	if err != nil {
+		if ci.t != nil {
+			ci.t.Stop()
+		}
 		c.ChanAsynRet <- &RetInfo{err: err, cb: cb}
 		return
 	}
 }
 
 func (c *Client) AsynCall(id interface{}, _args ...interface{}) {
+	c.asynCallTimeout(c.timeout, id, _args)
+}
+
+// the callback is invoked with ErrTimeout if the server does not
+// reply within d, a late reply is dropped
+func (c *Client) AsynCallWithTimeout(d time.Duration, id interface{}, _args ...interface{}) {
+	c.asynCallTimeout(d, id, _args)
+}
+
+func (c *Client) asynCallTimeout(d time.Duration, id interface{}, _args []interface{}) {
 	if len(_args) < 1 {
 		panic("callback function not found")
 	}
+	if d > 0 && c.dispatcher == nil {
+		panic("timer dispatcher not set")
+	}
 
 	args := _args[:len(_args)-1]
 	cb := _args[len(_args)-1]
@@ -340,13 +696,13 @@ func (c *Client) AsynCall(id interface{}, _args ...interface{}) {
 	}
 
 	// too many calls
-	if c.pendingAsynCall >= cap(c.ChanAsynRet) {
+	if int(atomic.LoadInt32(&c.pendingAsynCall)) >= cap(c.ChanAsynRet) {
 		execCb(&RetInfo{err: errors.New("too many calls"), cb: cb})
 		return
 	}
 
-	c.asynCall(id, args, cb, n)
-	c.pendingAsynCall++
+	c.asynCall(id, args, cb, n, d)
+	atomic.AddInt32(&c.pendingAsynCall, 1)
 }
 
 func execCb(ri *RetInfo) {
@@ -377,16 +733,24 @@ func execCb(ri *RetInfo) {
 }
 
 func (c *Client) Cb(ri *RetInfo) {
-	c.pendingAsynCall--
+	if ri.t != nil {
+		ri.t.Stop()
+	}
+	atomic.AddInt32(&c.pendingAsynCall, -1)
 	execCb(ri)
 }
 
 func (c *Client) Close() {
-	for c.pendingAsynCall > 0 {
+	for atomic.LoadInt32(&c.pendingAsynCall) > 0 {
 		c.Cb(<-c.ChanAsynRet)
 	}
 }
 
 func (c *Client) Idle() bool {
-	return c.pendingAsynCall == 0
+	return atomic.LoadInt32(&c.pendingAsynCall) == 0
+}
+
+// goroutine safe
+func (c *Client) Pending() int {
+	return int(atomic.LoadInt32(&c.pendingAsynCall))
 }
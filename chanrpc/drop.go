@@ -0,0 +1,87 @@
+package chanrpc
+
+import (
+	"sync/atomic"
+
+	"github.com/shinjuwu/leaf/log"
+)
+
+type DropReason int
+
+const (
+	// the function id is not registered
+	DropUnregistered DropReason = iota
+	// the server is closed
+	DropClosed
+	// ChanCall is full, see DropPolicy.NonBlocking
+	DropFull
+	numDropReason
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropUnregistered:
+		return "unregistered"
+	case DropClosed:
+		return "closed"
+	case DropFull:
+		return "full"
+	default:
+		return "unknown"
+	}
+}
+
+// a call dropped by Server.Go
+type DeadLetter struct {
+	Reason DropReason
+	ID     interface{}
+	Args   []interface{}
+}
+
+// DropPolicy controls how Server.Go reports the calls it cannot deliver,
+// the dropped calls are always counted
+type DropPolicy struct {
+	// log the dropped calls
+	Log bool
+	// drop the call instead of blocking when ChanCall is full
+	NonBlocking bool
+	// invoked on the goroutine calling Go, must goroutine safe
+	Fallback func(reason DropReason, id interface{}, args []interface{})
+	// the dropped calls are sent to DeadLetter without blocking,
+	// they are lost if DeadLetter is full
+	DeadLetter chan *DeadLetter
+}
+
+// you must call the function before calling Open and Go
+func (s *Server) SetDropPolicy(p DropPolicy) {
+	s.dropPolicy = p
+}
+
+// goroutine safe
+func (s *Server) Dropped(reason DropReason) uint64 {
+	return atomic.LoadUint64(&s.dropped[reason])
+}
+
+func (s *Server) drop(reason DropReason, id interface{}, args []interface{}) {
+	atomic.AddUint64(&s.dropped[reason], 1)
+
+	p := &s.dropPolicy
+	if p.Log {
+		log.Error("function id %v: call dropped (%v)", id, reason)
+	}
+	if p.DeadLetter != nil {
+		select {
+		case p.DeadLetter <- &DeadLetter{Reason: reason, ID: id, Args: args}:
+		default:
+		}
+	}
+	if p.Fallback != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error("%v", panicError(r))
+			}
+		}()
+
+		p.Fallback(reason, id, args)
+	}
+}
@@ -1,9 +1,14 @@
 package chanrpc_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/shinjuwu/leaf/chanrpc"
+	"github.com/shinjuwu/leaf/timer"
 	"sync"
+	"time"
 )
 
 func Example() {
@@ -125,3 +130,330 @@ func Example() {
 	// 1 2 3
 	// 3
 }
+
+func ExampleClient_Call1Ctx() {
+	s := chanrpc.NewServer(10)
+
+	s.Register("f1", func(args []interface{}) interface{} {
+		return 1
+	})
+
+	// nobody serves s, the call times out
+	c := s.Open(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.Call1Ctx(ctx, "f1")
+	fmt.Println(err)
+
+	// the abandoned call is skipped once s is served
+	go func() {
+		for {
+			s.Exec(<-s.ChanCall)
+		}
+	}()
+
+	r1, err := c.Call1Ctx(context.Background(), "f1")
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Println(r1)
+	}
+
+	// Output:
+	// context deadline exceeded
+	// 1
+}
+
+func ExampleClient_AsynCallWithTimeout() {
+	s := chanrpc.NewServer(10)
+
+	s.Register("f1", func(args []interface{}) interface{} {
+		return 1
+	})
+
+	d := timer.NewDispatcher(10)
+	c := s.Open(10)
+	c.SetTimeout(d, 0)
+
+	// nobody serves s, the call times out
+	c.AsynCallWithTimeout(time.Millisecond, "f1", func(ret interface{}, err error) {
+		fmt.Println(err)
+	})
+
+	// dispatch
+	(<-d.ChanTimer).Cb()
+	fmt.Println(c.Idle())
+
+	// Output:
+	// chanrpc call timeout
+	// true
+}
+
+func ExampleServer_AddInterceptor() {
+	s := chanrpc.NewServer(10)
+
+	s.Register("add", func(args []interface{}) interface{} {
+		return args[0].(int) + args[1].(int)
+	})
+
+	s.Register("panic", func(args []interface{}) {
+		panic("boom")
+	})
+
+	// logging
+	s.AddInterceptor(func(id interface{}, args []interface{}, next chanrpc.Handler) (interface{}, error) {
+		ret, err := next(args)
+		fmt.Println(id, args, ret, err)
+		return ret, err
+	})
+
+	// auth
+	s.AddInterceptor(func(id interface{}, args []interface{}, next chanrpc.Handler) (interface{}, error) {
+		if len(args) > 0 && args[0] == 0 {
+			return nil, errors.New("denied")
+		}
+		return next(args)
+	})
+
+	go func() {
+		for {
+			s.Exec(<-s.ChanCall)
+		}
+	}()
+
+	c := s.Open(0)
+	c.Call1("add", 1, 2)
+	c.Call1("add", 0, 2)
+	c.Call0("panic")
+
+	// internal calls skip the interceptors
+	s.Flush(context.Background())
+
+	// Output:
+	// add [1 2] 3 <nil>
+	// add [0 2] <nil> denied
+	// panic [] <nil> boom
+}
+
+func ExampleServer_RegisterTyped() {
+	s := chanrpc.NewServer(10)
+
+	s.RegisterTyped("add", func(n1 int, n2 int) int {
+		return n1 + n2
+	})
+
+	s.RegisterTyped("div", func(n1 int, n2 int) (int, int, error) {
+		if n2 == 0 {
+			return 0, 0, errors.New("division by zero")
+		}
+		return n1 / n2, n1 % n2, nil
+	})
+
+	go func() {
+		for {
+			s.Exec(<-s.ChanCall)
+		}
+	}()
+
+	c := s.Open(0)
+
+	ra, err := c.Call1("add", 1, 2)
+	fmt.Println(ra, err)
+
+	rd, err := c.CallN("div", 7, 2)
+	fmt.Println(rd, err)
+
+	_, err = c.CallN("div", 7, 0)
+	fmt.Println(err)
+
+	_, err = c.Call1("add", 1, "2")
+	fmt.Println(err)
+
+	// Output:
+	// 3 <nil>
+	// [3 1] <nil>
+	// division by zero
+	// function id add: arg 1: string is not assignable to int
+}
+
+func ExampleServer_SetDropPolicy() {
+	s := chanrpc.NewServer(1)
+
+	s.Register("f0", func(args []interface{}) {
+
+	})
+
+	s.SetDropPolicy(chanrpc.DropPolicy{
+		NonBlocking: true,
+		Fallback: func(reason chanrpc.DropReason, id interface{}, args []interface{}) {
+			fmt.Println(reason, id)
+		},
+	})
+
+	s.Go("f1")
+	s.Go("f0")
+	s.Go("f0")
+	s.Close()
+	s.Go("f0")
+
+	fmt.Println(s.Dropped(chanrpc.DropUnregistered),
+		s.Dropped(chanrpc.DropFull),
+		s.Dropped(chanrpc.DropClosed))
+
+	// Output:
+	// unregistered f1
+	// full f0
+	// closed f0
+	// 1 1 1
+}
+
+func ExampleServer_GoPriority() {
+	s := chanrpc.NewServer(10)
+
+	s.Register("print", func(args []interface{}) {
+		fmt.Println(args[0])
+	})
+
+	// without the priority lane
+	s.GoPriority("print", "first")
+	s.Go("print", "second")
+	s.Exec(<-s.ChanCall)
+	s.Exec(<-s.ChanCall)
+
+	// the loop below drains ChanPriorityCall first
+	s.EnablePriority()
+	s.Go("print", "normal")
+	s.GoPriority("print", "priority")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case ci := <-s.ChanPriorityCall:
+			s.Exec(ci)
+			continue
+		default:
+		}
+		s.Exec(<-s.ChanCall)
+	}
+
+	// Output:
+	// first
+	// second
+	// priority
+	// normal
+}
+
+func ExampleFuture() {
+	s := chanrpc.NewServer(10)
+
+	s.Register("add", func(args []interface{}) interface{} {
+		return args[0].(int) + args[1].(int)
+	})
+
+	go func() {
+		for {
+			s.Exec(<-s.ChanCall)
+		}
+	}()
+
+	c := s.Open(10)
+
+	// (1 + 2) + 3
+	f1 := c.AsynCallFuture("add", 1, 2).Then(func(ret interface{}) *chanrpc.Future {
+		return c.AsynCallFuture("add", ret, 3)
+	})
+
+	// 1 + 1, 2 + 2
+	f2 := chanrpc.WaitAll(c.AsynCallFuture("add", 1, 1), c.AsynCallFuture("add", 2, 2))
+
+	chanrpc.WaitAll(f1, f2).OnComplete(func(ret interface{}, err error) {
+		fmt.Println(ret, err)
+	})
+
+	for !c.Idle() {
+		c.Cb(<-c.ChanAsynRet)
+	}
+
+	// Output:
+	// [6 [2 4]] <nil>
+}
+
+func ExampleReplay() {
+	newServer := func() *chanrpc.Server {
+		s := chanrpc.NewServer(10)
+		sum := 0
+		s.Register("add", func(args []interface{}) {
+			sum += args[0].(int)
+			fmt.Println(sum)
+		})
+		return s
+	}
+
+	// record
+	var buf bytes.Buffer
+	s := newServer()
+	r := chanrpc.NewRecorder(&buf, chanrpc.GobEncoder{})
+	s.SetRecorder(r)
+	s.Go("add", 1)
+	s.Go("add", 2)
+	flushed := make(chan error)
+	go func() {
+		flushed <- s.Flush(context.Background())
+	}()
+	for i := 0; i < 3; i++ {
+		s.Exec(<-s.ChanCall)
+	}
+	<-flushed
+	r.Close()
+
+	// replay
+	err := chanrpc.Replay(newServer(), &buf, chanrpc.GobEncoder{})
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	// Output:
+	// 1
+	// 3
+	// 1
+	// 3
+}
+
+func ExampleServer_Stats() {
+	s := chanrpc.NewServer(10)
+
+	s.Register("sleep", func(args []interface{}) {
+		time.Sleep(15 * time.Millisecond)
+	})
+
+	s.RegisterTyped("check", func(n int) error {
+		if n < 0 {
+			return errors.New("negative")
+		}
+		return nil
+	})
+
+	s.Register("panic", func(args []interface{}) {
+		panic("boom")
+	})
+
+	s.Go("sleep")
+	s.Go("check", 1)
+	s.Go("check", -1)
+	s.Go("panic")
+	for i := 0; i < 4; i++ {
+		s.Exec(<-s.ChanCall)
+	}
+
+	for _, fs := range s.Stats() {
+		fmt.Println(fs.ID, fs.Calls, fs.Errors, fs.Panics, fs.Max >= fs.Avg())
+	}
+
+	// [10ms, 100ms)
+	fmt.Println(s.Stats()[2].Latency)
+
+	// Output:
+	// check 2 1 0 true
+	// panic 1 1 1 true
+	// sleep 1 0 0 true
+	// [0 0 1 0 0]
+}
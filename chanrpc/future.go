@@ -0,0 +1,178 @@
+package chanrpc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/shinjuwu/leaf/log"
+)
+
+// Future is the result of an asynchronous call. It is resolved by
+// Client.Cb, so the continuations run on the goroutine that owns the
+// client (goroutine not safe)
+type Future struct {
+	done bool
+	ret  interface{}
+	err  error
+	cbs  []func(ret interface{}, err error)
+}
+
+// a future already resolved with ret and err
+func Resolved(ret interface{}, err error) *Future {
+	f := new(Future)
+	f.resolve(ret, err)
+	return f
+}
+
+func (f *Future) resolve(ret interface{}, err error) {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.ret = ret
+	f.err = err
+
+	cbs := f.cbs
+	f.cbs = nil
+	for _, cb := range cbs {
+		execFutureCb(cb, ret, err)
+	}
+}
+
+func execFutureCb(cb func(interface{}, error), ret interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("%v", panicError(r))
+		}
+	}()
+
+	cb(ret, err)
+}
+
+func (f *Future) Done() bool {
+	return f.done
+}
+
+// the result is valid only if the future is done
+// ret:
+// nil           - func([]interface{})
+// interface{}   - func([]interface{}) interface{}
+// []interface{} - func([]interface{}) []interface{}
+func (f *Future) Result() (interface{}, error) {
+	return f.ret, f.err
+}
+
+// cb is invoked once the future is resolved, immediately if it is done
+func (f *Future) OnComplete(cb func(ret interface{}, err error)) {
+	if f.done {
+		execFutureCb(cb, f.ret, f.err)
+		return
+	}
+
+	f.cbs = append(f.cbs, cb)
+}
+
+// next is invoked with the result of f if f succeeds, the returned future
+// is resolved with the result of the future returned by next.
+// an error of f (or a panic of next) skips the rest of the chain
+func (f *Future) Then(next func(ret interface{}) *Future) *Future {
+	nf := new(Future)
+	f.OnComplete(func(ret interface{}, err error) {
+		if err != nil {
+			nf.resolve(nil, err)
+			return
+		}
+
+		var cf *Future
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Error("%v", panicError(r))
+					cf = Resolved(nil, fmt.Errorf("%v", r))
+				}
+			}()
+
+			cf = next(ret)
+		}()
+		if cf == nil {
+			cf = Resolved(nil, nil)
+		}
+		cf.OnComplete(nf.resolve)
+	})
+	return nf
+}
+
+// the returned future is resolved with the results of fs in order
+// ([]interface{}) once they all succeed, or with the first error
+func WaitAll(fs ...*Future) *Future {
+	nf := new(Future)
+	rets := make([]interface{}, len(fs))
+	pending := len(fs)
+	if pending == 0 {
+		nf.resolve(rets, nil)
+		return nf
+	}
+
+	for i, f := range fs {
+		i := i
+		f.OnComplete(func(ret interface{}, err error) {
+			if err != nil {
+				nf.resolve(nil, err)
+				return
+			}
+
+			rets[i] = ret
+			pending--
+			if pending == 0 {
+				nf.resolve(rets, nil)
+			}
+		})
+	}
+	return nf
+}
+
+// the returned future is resolved with the result of the first
+// resolved future of fs
+func WaitAny(fs ...*Future) *Future {
+	nf := new(Future)
+	if len(fs) == 0 {
+		nf.resolve(nil, errors.New("no future to wait"))
+		return nf
+	}
+
+	for _, f := range fs {
+		f.OnComplete(nf.resolve)
+	}
+	return nf
+}
+
+// AsynCall returning a future instead of invoking a callback
+func (c *Client) AsynCallFuture(id interface{}, args ...interface{}) *Future {
+	f := new(Future)
+
+	n := 1
+	if c.s != nil {
+		if fn := c.s.function(id); fn != nil {
+			n = kind(fn)
+		}
+	}
+
+	var cb interface{}
+	switch n {
+	case 0:
+		cb = func(err error) {
+			f.resolve(nil, err)
+		}
+	case 1:
+		cb = func(ret interface{}, err error) {
+			f.resolve(ret, err)
+		}
+	case 2:
+		cb = func(ret []interface{}, err error) {
+			f.resolve(ret, err)
+		}
+	}
+
+	c.AsynCall(id, append(args[:len(args):len(args)], cb)...)
+	return f
+}
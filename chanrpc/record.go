@@ -0,0 +1,190 @@
+package chanrpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/shinjuwu/leaf/log"
+)
+
+// ArgEncoder encodes the id and the args of the recorded calls
+type ArgEncoder interface {
+	Encode(id interface{}, args []interface{}) ([]byte, error)
+	Decode(data []byte) (id interface{}, args []interface{}, err error)
+}
+
+// the concrete types of the ids and the args must be registered by gob.Register
+type GobEncoder struct{}
+
+type gobCall struct {
+	ID   interface{}
+	Args []interface{}
+}
+
+func (GobEncoder) Encode(id interface{}, args []interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&gobCall{ID: id, Args: args})
+	return buf.Bytes(), err
+}
+
+func (GobEncoder) Decode(data []byte) (interface{}, []interface{}, error) {
+	var c gobCall
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&c)
+	return c.ID, c.Args, err
+}
+
+type Record struct {
+	// when the call started
+	Time    time.Time
+	Elapsed time.Duration
+	ID      interface{}
+	Args    []interface{}
+}
+
+// record layout:
+// ---------------------------------------------------
+// | time | elapsed | len | id and args (ArgEncoder) |
+// ---------------------------------------------------
+// time and elapsed are int64 nanoseconds, len is uint32, big endian
+type Recorder struct {
+	mutex  sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+	enc    ArgEncoder
+}
+
+func NewRecorder(w io.Writer, enc ArgEncoder) *Recorder {
+	r := new(Recorder)
+	r.w = bufio.NewWriter(w)
+	if c, ok := w.(io.Closer); ok {
+		r.closer = c
+	}
+	r.enc = enc
+	return r
+}
+
+func CreateRecorder(filename string, enc ArgEncoder) (*Recorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(f, enc), nil
+}
+
+func (r *Recorder) write(start time.Time, elapsed time.Duration, data []byte) {
+	var head [20]byte
+	binary.BigEndian.PutUint64(head[0:], uint64(start.UnixNano()))
+	binary.BigEndian.PutUint64(head[8:], uint64(elapsed))
+	binary.BigEndian.PutUint32(head[16:], uint32(len(data)))
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.w == nil {
+		return
+	}
+	r.w.Write(head[:])
+	_, err := r.w.Write(data)
+	if err != nil {
+		log.Error("chanrpc record error: %v", err)
+	}
+}
+
+// goroutine safe
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.w == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	r.w = nil
+	if r.closer != nil {
+		if cerr := r.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// goroutine safe
+// the calls executed by s are written to r, nil stops recording.
+// you must close the previous recorder yourself
+func (s *Server) SetRecorder(r *Recorder) {
+	s.recorder.Store(r)
+}
+
+func (s *Server) getRecorder() *Recorder {
+	r, _ := s.recorder.Load().(*Recorder)
+	return r
+}
+
+// Player reads the records written by a Recorder
+type Player struct {
+	r   *bufio.Reader
+	dec ArgEncoder
+}
+
+func NewPlayer(r io.Reader, dec ArgEncoder) *Player {
+	p := new(Player)
+	p.r = bufio.NewReader(r)
+	p.dec = dec
+	return p
+}
+
+// returns io.EOF after the last record
+func (p *Player) Next() (*Record, error) {
+	var head [20]byte
+	_, err := io.ReadFull(p.r, head[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated record")
+		}
+		return nil, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(head[16:]))
+	_, err = io.ReadFull(p.r, data)
+	if err != nil {
+		return nil, errors.New("truncated record")
+	}
+
+	rec := new(Record)
+	rec.Time = time.Unix(0, int64(binary.BigEndian.Uint64(head[0:])))
+	rec.Elapsed = time.Duration(binary.BigEndian.Uint64(head[8:]))
+	rec.ID, rec.Args, err = p.dec.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Replay executes the recorded calls on s in order. The calls are executed
+// on the calling goroutine, which must own s (for instance a test driving a
+// module that is not running)
+func Replay(s *Server, r io.Reader, dec ArgEncoder) error {
+	p := NewPlayer(r, dec)
+	for {
+		rec, err := p.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if s.function(rec.ID) == nil {
+			return fmt.Errorf("function id %v: function not registered", rec.ID)
+		}
+		s.Invoke(rec.ID, rec.Args...)
+	}
+}
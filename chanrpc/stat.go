@@ -0,0 +1,84 @@
+package chanrpc
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// the upper bounds of the latency histogram, the last bucket counts
+// the calls slower than LatencyBuckets[len(LatencyBuckets)-1]
+var LatencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+type FuncStat struct {
+	ID      interface{}
+	Calls   uint64
+	Errors  uint64
+	Panics  uint64
+	Total   time.Duration
+	Max     time.Duration
+	Latency [len(LatencyBuckets) + 1]uint64
+}
+
+func (fs *FuncStat) Avg() time.Duration {
+	if fs.Calls == 0 {
+		return 0
+	}
+	return fs.Total / time.Duration(fs.Calls)
+}
+
+func (s *Server) record(id interface{}, d time.Duration, failed bool, panicked bool) {
+	s.mutexStats.Lock()
+	defer s.mutexStats.Unlock()
+
+	fs := s.stats[id]
+	if fs == nil {
+		fs = &FuncStat{ID: id}
+		s.stats[id] = fs
+	}
+
+	fs.Calls++
+	if failed {
+		fs.Errors++
+	}
+	if panicked {
+		fs.Panics++
+	}
+	fs.Total += d
+	if d > fs.Max {
+		fs.Max = d
+	}
+
+	i := 0
+	for i < len(LatencyBuckets) && d >= LatencyBuckets[i] {
+		i++
+	}
+	fs.Latency[i]++
+}
+
+// goroutine safe
+// returns a snapshot sorted by id
+func (s *Server) Stats() []FuncStat {
+	s.mutexStats.Lock()
+	stats := make([]FuncStat, 0, len(s.stats))
+	for _, fs := range s.stats {
+		stats = append(stats, *fs)
+	}
+	s.mutexStats.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		return fmt.Sprint(stats[i].ID) < fmt.Sprint(stats[j].ID)
+	})
+	return stats
+}
+
+// goroutine safe
+// the number of calls waiting in ChanCall and ChanPriorityCall
+func (s *Server) Len() int {
+	return len(s.ChanCall) + len(s.ChanPriorityCall)
+}
@@ -0,0 +1,106 @@
+package chanrpc
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
+// a function registered by RegisterTyped
+type typedFunc struct {
+	id     interface{}
+	f      reflect.Value
+	in     []reflect.Type
+	nOut   int
+	hasErr bool
+}
+
+func (tf *typedFunc) n() int {
+	if tf.nOut > 2 {
+		return 2
+	}
+	return tf.nOut
+}
+
+// f is a function of any signature, a trailing error result is returned
+// as the error of the call:
+// func(*msg.Login, gate.Agent)                        - Call0
+// func(*msg.Login, gate.Agent) error                  - Call0
+// func(*msg.Login, gate.Agent) (*msg.LoginResp, error) - Call1
+// func(*msg.Login, gate.Agent) (int, int, error)      - CallN
+//
+// goroutine safe
+func (s *Server) RegisterTyped(id interface{}, f interface{}) {
+	v := reflect.ValueOf(f)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		panic(fmt.Sprintf("function id %v: definition of function is invalid", id))
+	}
+	t := v.Type()
+	if t.IsVariadic() {
+		panic(fmt.Sprintf("function id %v: variadic function is not supported", id))
+	}
+
+	tf := new(typedFunc)
+	tf.id = id
+	tf.f = v
+	tf.in = make([]reflect.Type, t.NumIn())
+	for i := 0; i < t.NumIn(); i++ {
+		tf.in[i] = t.In(i)
+	}
+	tf.nOut = t.NumOut()
+	if tf.nOut > 0 && t.Out(tf.nOut-1) == typeOfError {
+		tf.nOut--
+		tf.hasErr = true
+	}
+
+	s.register(id, tf)
+}
+
+func (tf *typedFunc) call(args []interface{}) (interface{}, error) {
+	if len(args) != len(tf.in) {
+		return nil, fmt.Errorf("function id %v: expected %v args, got %v", tf.id, len(tf.in), len(args))
+	}
+
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		t := tf.in[i]
+		if arg == nil {
+			switch t.Kind() {
+			case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+				in[i] = reflect.Zero(t)
+				continue
+			}
+			return nil, fmt.Errorf("function id %v: arg %v: nil is not assignable to %v", tf.id, i, t)
+		}
+
+		v := reflect.ValueOf(arg)
+		if !v.Type().AssignableTo(t) {
+			return nil, fmt.Errorf("function id %v: arg %v: %v is not assignable to %v", tf.id, i, v.Type(), t)
+		}
+		in[i] = v
+	}
+
+	out := tf.f.Call(in)
+
+	var err error
+	if tf.hasErr {
+		if e := out[tf.nOut]; !e.IsNil() {
+			err = e.Interface().(error)
+		}
+		out = out[:tf.nOut]
+	}
+
+	switch len(out) {
+	case 0:
+		return nil, err
+	case 1:
+		return out[0].Interface(), err
+	default:
+		ret := make([]interface{}, len(out))
+		for i, v := range out {
+			ret[i] = v.Interface()
+		}
+		return ret, err
+	}
+}
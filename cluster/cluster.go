@@ -1,65 +1,188 @@
 package cluster
 
 import (
+	"encoding/json"
 	"github.com/shinjuwu/leaf/conf"
+	"github.com/shinjuwu/leaf/log"
 	"github.com/shinjuwu/leaf/network"
+	"github.com/shinjuwu/leaf/timer"
 	"math"
+	"sync"
 	"time"
 )
 
-var (
-	server  *network.TCPServer
-	clients []*network.TCPClient
-)
+// NodeID: the id of the node in heartbeats, unique in the cluster,
+// the host name and the process id if empty.
+// HeartbeatInterval: 1s if 0, a peer is down after 3 missed heartbeats
+type Cluster struct {
+	NodeID            string
+	ListenAddr        string
+	ConnAddrs         []string
+	PendingWriteNum   int
+	HeartbeatInterval time.Duration
+	server            *network.TCPServer
+	clients           []*network.TCPClient
+	clock             timer.Clock
+
+	mutex     sync.Mutex
+	agents    map[*Agent]struct{}
+	peers     map[string]*peer
+	jobs      map[string]*job
+	started   time.Time
+	leaving   bool
+	duplicate bool
+	closeSig  chan bool
+}
+
+var std = New()
+
+// the cluster used by the package level functions
+func Default() *Cluster {
+	return std
+}
+
+func New() *Cluster {
+	return new(Cluster)
+}
 
 func Init() {
-	if conf.ListenAddr != "" {
-		server = new(network.TCPServer)
-		server.Addr = conf.ListenAddr
-		server.MaxConnNum = int(math.MaxInt32)
-		server.PendingWriteNum = conf.PendingWriteNum
-		server.LenMsgLen = 4
-		server.MaxMsgLen = math.MaxUint32
-		server.NewAgent = newAgent
-
-		server.Start()
+	std.NodeID = conf.NodeID
+	std.ListenAddr = conf.ListenAddr
+	std.ConnAddrs = conf.ConnAddrs
+	std.PendingWriteNum = conf.PendingWriteNum
+	std.Init()
+}
+
+func Stop() {
+	std.Stop()
+}
+
+func Destroy() {
+	std.Destroy()
+}
+
+// goroutine safe
+func IsOwner(name string) bool {
+	return std.IsOwner(name)
+}
+
+func CronFunc(disp *timer.Dispatcher, name string, cronExpr *timer.CronExpr, cb func()) *timer.Cron {
+	return std.CronFunc(disp, name, cronExpr, cb)
+}
+
+func (c *Cluster) Init() {
+	if c.NodeID == "" {
+		c.NodeID = defaultNodeID()
+	}
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = time.Second
+	}
+	if c.clock == nil {
+		c.clock = timer.RealClock
+	}
+	c.mutex.Lock()
+	c.agents = make(map[*Agent]struct{})
+	c.peers = make(map[string]*peer)
+	if c.jobs == nil {
+		c.jobs = make(map[string]*job)
+	}
+	c.started = c.clock.Now()
+	c.mutex.Unlock()
+	c.closeSig = make(chan bool)
+	go c.heartbeat()
+
+	if c.ListenAddr != "" {
+		c.server = new(network.TCPServer)
+		c.server.Addr = c.ListenAddr
+		c.server.MaxConnNum = int(math.MaxInt32)
+		c.server.PendingWriteNum = c.PendingWriteNum
+		c.server.LenMsgLen = 4
+		c.server.MaxMsgLen = math.MaxUint32
+		c.server.NewAgent = c.newAgent
+
+		c.server.Start()
 	}
 
-	for _, addr := range conf.ConnAddrs {
+	for _, addr := range c.ConnAddrs {
 		client := new(network.TCPClient)
 		client.Addr = addr
 		client.ConnNum = 1
 		client.ConnectInterval = 3 * time.Second
-		client.PendingWriteNum = conf.PendingWriteNum
+		client.PendingWriteNum = c.PendingWriteNum
 		client.LenMsgLen = 4
 		client.MaxMsgLen = math.MaxUint32
-		client.NewAgent = newAgent
+		client.NewAgent = c.newAgent
 
 		client.Start()
-		clients = append(clients, client)
+		c.clients = append(c.clients, client)
 	}
 }
 
-func Destroy() {
-	if server != nil {
-		server.Close()
+// stop accepting new connections,
+// the peers take over the singleton jobs of the node
+func (c *Cluster) Stop() {
+	if c.server != nil {
+		c.server.CloseListener()
+	}
+	c.leave()
+}
+
+func (c *Cluster) Destroy() {
+	if c.closeSig != nil {
+		close(c.closeSig)
 	}
 
-	for _, client := range clients {
+	if c.server != nil {
+		c.server.Close()
+	}
+
+	for _, client := range c.clients {
 		client.Close()
 	}
 }
 
 type Agent struct {
-	conn *network.TCPConn
+	cluster *Cluster
+	conn    *network.TCPConn
 }
 
-func newAgent(conn *network.TCPConn) network.Agent {
+func (c *Cluster) newAgent(conn *network.TCPConn) network.Agent {
 	a := new(Agent)
+	a.cluster = c
 	a.conn = conn
+
+	c.mutex.Lock()
+	c.agents[a] = struct{}{}
+	c.mutex.Unlock()
 	return a
 }
 
-func (a *Agent) Run() {}
+func (a *Agent) Run() {
+	// the peer learns about the node without waiting for the next heartbeat
+	data, err := json.Marshal(a.cluster.heartbeatMessage())
+	if err == nil {
+		a.conn.WriteMsg(data)
+	}
+
+	for {
+		data, err := a.conn.ReadMsg()
+		if err != nil {
+			log.Debug("read message: %v", err)
+			break
+		}
 
-func (a *Agent) OnClose() {}
+		var msg message
+		err = json.Unmarshal(data, &msg)
+		if err != nil {
+			log.Debug("unmarshal message: %v", err)
+			break
+		}
+		a.cluster.handle(&msg)
+	}
+}
+
+func (a *Agent) OnClose() {
+	a.cluster.mutex.Lock()
+	delete(a.cluster.agents, a)
+	a.cluster.mutex.Unlock()
+}
@@ -0,0 +1,344 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/shinjuwu/leaf/log"
+	"github.com/shinjuwu/leaf/timer"
+)
+
+// the messages between the nodes.
+// a heartbeat carries the singleton jobs the node holds and claims,
+// Ready once the node is past its grace period
+type message struct {
+	Heartbeat string   `json:",omitempty"`
+	Ready     bool     `json:",omitempty"`
+	Leases    []string `json:",omitempty"`
+	Claims    []string `json:",omitempty"`
+	Leave     string   `json:",omitempty"`
+}
+
+// the last heartbeat of a peer
+type peer struct {
+	lastSeen time.Time
+	ready    bool
+	leases   map[string]bool
+	claims   map[string]bool
+}
+
+const (
+	jobIdle = iota
+	jobClaimed
+	jobHeld
+)
+
+// a singleton job of the node
+type job struct {
+	state int
+	since time.Time
+}
+
+// the nodes on different hosts often share the same ListenAddr
+func defaultNodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%v:%v", host, os.Getpid())
+}
+
+func (c *Cluster) heartbeat() {
+	ticker := time.NewTicker(c.HeartbeatInterval)
+	defer ticker.Stop()
+
+	c.broadcast(c.heartbeatMessage())
+	for {
+		select {
+		case <-c.closeSig:
+			return
+		case <-ticker.C:
+			c.tick()
+			c.mutex.Lock()
+			leaving := c.leaving
+			c.mutex.Unlock()
+			if !leaving {
+				c.broadcast(c.heartbeatMessage())
+			}
+		}
+	}
+}
+
+// best effort, the peers drop a node after three missed heartbeats anyway.
+// the jobs of the node are released first
+func (c *Cluster) leave() {
+	if c.closeSig == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	c.leaving = true
+	for _, j := range c.jobs {
+		j.state = jobIdle
+	}
+	c.mutex.Unlock()
+	c.broadcast(&message{Leave: c.NodeID})
+}
+
+func (c *Cluster) broadcast(msg *message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Error("marshal message: %v", err)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for a := range c.agents {
+		err := a.conn.WriteMsg(data)
+		if err != nil {
+			log.Debug("write message: %v", err)
+		}
+	}
+}
+
+func (c *Cluster) heartbeatMessage() *message {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	msg := &message{Heartbeat: c.NodeID, Ready: c.ready()}
+	for name, j := range c.jobs {
+		switch j.state {
+		case jobHeld:
+			msg.Leases = append(msg.Leases, name)
+		case jobClaimed:
+			msg.Claims = append(msg.Claims, name)
+		}
+	}
+	sort.Strings(msg.Leases)
+	sort.Strings(msg.Claims)
+	return msg
+}
+
+func (c *Cluster) handle(msg *message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if msg.Heartbeat == c.NodeID {
+		if !c.duplicate {
+			c.duplicate = true
+			log.Error("node id %v is used by a peer, the peer is ignored", c.NodeID)
+		}
+	} else if msg.Heartbeat != "" {
+		// the jobs missing from the heartbeat are released
+		p := &peer{
+			lastSeen: c.clock.Now(),
+			ready:    msg.Ready,
+			leases:   make(map[string]bool),
+			claims:   make(map[string]bool),
+		}
+		for _, name := range msg.Leases {
+			p.leases[name] = true
+		}
+		for _, name := range msg.Claims {
+			p.claims[name] = true
+		}
+		c.peers[msg.Heartbeat] = p
+	}
+	if msg.Leave != "" {
+		delete(c.peers, msg.Leave)
+	}
+}
+
+// the ids of the live nodes, the node itself included unless it is leaving.
+// goroutine safe
+func (c *Cluster) LiveNodes() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var nodes []string
+	if !c.leaving {
+		nodes = append(nodes, c.NodeID)
+	}
+	for id := range c.livePeers() {
+		nodes = append(nodes, id)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (c *Cluster) livePeers() map[string]*peer {
+	peers := make(map[string]*peer)
+	now := c.clock.Now()
+	timeout := 3 * c.HeartbeatInterval
+	for id, p := range c.peers {
+		if now.Sub(p.lastSeen) < timeout {
+			peers[id] = p
+		}
+	}
+	return peers
+}
+
+// a node claims no job until it has heard from its live peers
+func (c *Cluster) ready() bool {
+	return !c.leaving && c.clock.Now().Sub(c.started) >= 3*c.HeartbeatInterval
+}
+
+// the rank of a node for a job by rendezvous hashing,
+// the jobs of a node which goes down move to the other nodes
+func rank(name string, id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(id))
+	return mix(h.Sum64())
+}
+
+// the finalizer of splitmix64, fnv alone keeps the nodes of similar ids
+// in the same order for most names
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// the node of the highest rank
+func rendezvous(name string, nodes []string) string {
+	var owner string
+	var max uint64
+	for _, id := range nodes {
+		if r := rank(name, id); owner == "" || r > max {
+			owner = id
+			max = r
+		}
+	}
+	return owner
+}
+
+// the jobs move between the nodes by leases.
+// the node of the highest rank among the ready ones claims a job nobody
+// holds, and holds it if no peer of a higher rank claims it within a
+// heartbeat. the holder renews the lease in its heartbeats and releases it
+// when a node of a higher rank is ready. the lease of a peer expires when
+// the peer is down
+func (c *Cluster) tick() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.clock.Now()
+	peers := c.livePeers()
+	var nodes []string
+	if c.ready() {
+		nodes = append(nodes, c.NodeID)
+	}
+	for id, p := range peers {
+		if p.ready {
+			nodes = append(nodes, id)
+		}
+	}
+
+	for name, j := range c.jobs {
+		owner := rendezvous(name, nodes)
+		mine := rank(name, c.NodeID)
+		holder, rival := false, false
+		for id, p := range peers {
+			if p.leases[name] {
+				holder = true
+			}
+			if (p.leases[name] || p.claims[name]) && rank(name, id) > mine {
+				rival = true
+			}
+		}
+
+		switch j.state {
+		case jobIdle:
+			if owner == c.NodeID && !holder {
+				j.state = jobClaimed
+				j.since = now
+			}
+		case jobClaimed:
+			if owner != c.NodeID || rival || holder {
+				j.state = jobIdle
+			} else if now.Sub(j.since) >= c.HeartbeatInterval {
+				j.state = jobHeld
+				log.Release("singleton job %v is held by %v", name, c.NodeID)
+			}
+		case jobHeld:
+			if owner != c.NodeID || rival {
+				j.state = jobIdle
+				log.Release("singleton job %v is released by %v", name, c.NodeID)
+			}
+		}
+	}
+}
+
+// the node which holds the lease of the job name, empty if none is known.
+// goroutine safe
+func (c *Cluster) Owner(name string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if j := c.jobs[name]; j != nil && j.state == jobHeld && !c.leaving {
+		return c.NodeID
+	}
+	var owners []string
+	for id, p := range c.livePeers() {
+		if p.leases[name] {
+			owners = append(owners, id)
+		}
+	}
+	sort.Strings(owners)
+	if len(owners) == 0 {
+		return ""
+	}
+	return owners[0]
+}
+
+// whether the node holds the lease of the job name,
+// the node competes for the job from the first call.
+// goroutine safe
+func (c *Cluster) IsOwner(name string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	j := c.job(name)
+	return j.state == jobHeld && !c.leaving
+}
+
+func (c *Cluster) job(name string) *job {
+	if c.jobs == nil {
+		c.jobs = make(map[string]*job)
+	}
+	j := c.jobs[name]
+	if j == nil {
+		j = new(job)
+		c.jobs[name] = j
+	}
+	return j
+}
+
+// every node schedules the job, only the node holding its lease runs it.
+// a run is never duplicated while the nodes reach each other within a
+// heartbeat, but the runs are skipped while nobody holds the lease: for four
+// heartbeats after the cluster starts or the holder goes down, and for two
+// heartbeats after a node of a higher rank is ready. the sides of a network
+// partition may both run the job, a job which must not run twice needs
+// a lock of its own, e.g. in the database
+func (c *Cluster) CronFunc(disp *timer.Dispatcher, name string, cronExpr *timer.CronExpr, cb func()) *timer.Cron {
+	c.mutex.Lock()
+	c.job(name)
+	c.mutex.Unlock()
+
+	return disp.CronFunc(cronExpr, func() {
+		if c.IsOwner(name) {
+			cb()
+		}
+	})
+}
@@ -0,0 +1,289 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shinjuwu/leaf/timer"
+)
+
+// a node with fake peers, no connections
+func newTestCluster(id string, peers ...string) *Cluster {
+	c := New()
+	c.NodeID = id
+	c.HeartbeatInterval = time.Hour
+	c.Init()
+	for _, peer := range peers {
+		c.handle(&message{Heartbeat: peer})
+	}
+	return c
+}
+
+func TestRendezvous(t *testing.T) {
+	owners := make(map[string]string)
+	count := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprint("job", i)
+		owner := rendezvous(name, []string{"a", "b", "c"})
+		if got := rendezvous(name, []string{"c", "b", "a"}); got != owner {
+			t.Fatalf("%v: owner %v, %v in another order", name, owner, got)
+		}
+		owners[name] = owner
+		count[owner]++
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if count[id] < 50 {
+			t.Errorf("%v owns %v of 300 jobs", id, count[id])
+		}
+	}
+
+	// c goes down, only its jobs move
+	for name, owner := range owners {
+		if got := rendezvous(name, []string{"a", "b"}); got == "c" || owner != "c" && got != owner {
+			t.Errorf("%v: owner %v, was %v", name, got, owner)
+		}
+	}
+}
+
+func TestLiveNodes(t *testing.T) {
+	a := newTestCluster("a", "b", "c")
+	defer a.Destroy()
+
+	if nodes := a.LiveNodes(); !reflect.DeepEqual(nodes, []string{"a", "b", "c"}) {
+		t.Fatalf("live nodes %v", nodes)
+	}
+
+	// c misses its heartbeats
+	a.mutex.Lock()
+	a.peers["c"].lastSeen = time.Now().Add(-4 * a.HeartbeatInterval)
+	a.mutex.Unlock()
+	if nodes := a.LiveNodes(); !reflect.DeepEqual(nodes, []string{"a", "b"}) {
+		t.Fatalf("live nodes %v", nodes)
+	}
+
+	// b leaves
+	a.handle(&message{Leave: "b"})
+	if nodes := a.LiveNodes(); !reflect.DeepEqual(nodes, []string{"a"}) {
+		t.Fatalf("live nodes %v", nodes)
+	}
+
+	// a leaves
+	a.leave()
+	if nodes := a.LiveNodes(); len(nodes) != 0 {
+		t.Fatalf("live nodes %v", nodes)
+	}
+}
+
+func TestDuplicateNodeID(t *testing.T) {
+	a := newTestCluster("a", "a", "b")
+	defer a.Destroy()
+
+	if !a.duplicate {
+		t.Error("duplicate node id not detected")
+	}
+	if nodes := a.LiveNodes(); !reflect.DeepEqual(nodes, []string{"a", "b"}) {
+		t.Fatalf("live nodes %v", nodes)
+	}
+}
+
+func TestDefaultNodeID(t *testing.T) {
+	// not ListenAddr, which the nodes on different hosts often share
+	id := defaultNodeID()
+	if !strings.HasSuffix(id, fmt.Sprintf(":%v", os.Getpid())) {
+		t.Errorf("node id %v", id)
+	}
+}
+
+// the nodes of a testNet exchange their heartbeats and run an hourly
+// singleton job by a virtual clock, a step is a heartbeat
+type testNet struct {
+	t     *testing.T
+	name  string
+	clock *timer.VirtualClock
+	nodes []*testNode
+	runs  []string
+}
+
+type testNode struct {
+	c    *Cluster
+	d    *timer.Dispatcher
+	down bool
+}
+
+func newTestNet(t *testing.T, name string) *testNet {
+	n := new(testNet)
+	n.t = t
+	n.name = name
+	n.clock = timer.NewVirtualClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	return n
+}
+
+// the name of a job whose nodes rank in the order of ids
+func jobName(ids ...string) string {
+	for i := 0; ; i++ {
+		name := fmt.Sprint("job", i)
+		ok := true
+		for j := 1; j < len(ids); j++ {
+			if rank(name, ids[j-1]) < rank(name, ids[j]) {
+				ok = false
+			}
+		}
+		if ok {
+			return name
+		}
+	}
+}
+
+func (n *testNet) join(id string) *testNode {
+	c := New()
+	c.NodeID = id
+	c.HeartbeatInterval = time.Hour
+	c.clock = n.clock
+	c.Init()
+
+	cronExpr, err := timer.NewCronExpr("0 0 * * * *")
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	node := &testNode{c: c, d: timer.NewDispatcherWithClock(10, n.clock)}
+	c.CronFunc(node.d, n.name, cronExpr, func() {
+		n.runs = append(n.runs, id)
+	})
+	n.nodes = append(n.nodes, node)
+
+	// the heartbeats sent on connect
+	for _, other := range n.nodes {
+		if other != node && !other.down {
+			other.c.handle(c.heartbeatMessage())
+			c.handle(other.c.heartbeatMessage())
+		}
+	}
+	return node
+}
+
+// the job fires on the nodes up, then they exchange their heartbeats.
+// returns the nodes which ran the job
+func (n *testNet) step() []string {
+	n.clock.Advance(time.Hour)
+
+	n.runs = nil
+	for _, node := range n.nodes {
+		for len(node.d.ChanTimer) > 0 {
+			t := <-node.d.ChanTimer
+			if !node.down {
+				t.Cb()
+			}
+		}
+	}
+	runs := n.runs
+
+	var msgs []*message
+	for _, node := range n.nodes {
+		if !node.down {
+			node.c.tick()
+			msgs = append(msgs, node.c.heartbeatMessage())
+		}
+	}
+	for _, msg := range msgs {
+		for _, node := range n.nodes {
+			if !node.down && node.c.NodeID != msg.Heartbeat {
+				node.c.handle(msg)
+			}
+		}
+	}
+	return runs
+}
+
+func (n *testNet) destroy() {
+	for _, node := range n.nodes {
+		node.c.Destroy()
+	}
+}
+
+func TestSingletonJoin(t *testing.T) {
+	n := newTestNet(t, jobName("c", "a", "b"))
+	defer n.destroy()
+	n.join("a")
+	n.join("b")
+
+	// the grace period, a claims the job and holds it a heartbeat later
+	var got [][]string
+	for i := 0; i < 6; i++ {
+		got = append(got, n.step())
+	}
+	want := [][]string{nil, nil, nil, nil, {"a"}, {"a"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("runs %v, want %v", got, want)
+	}
+
+	// c of a higher rank joins, a runs the job until it learns that c is ready
+	// and releases it, c claims it and holds it a heartbeat later
+	n.join("c")
+	got = nil
+	for i := 0; i < 8; i++ {
+		got = append(got, n.step())
+	}
+	want = [][]string{{"a"}, {"a"}, {"a"}, {"a"}, nil, nil, {"c"}, {"c"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("runs %v, want %v", got, want)
+	}
+}
+
+func TestSingletonOwnerDown(t *testing.T) {
+	n := newTestNet(t, jobName("a", "b"))
+	defer n.destroy()
+	a := n.join("a")
+	n.join("b")
+	for i := 0; i < 5; i++ {
+		n.step()
+	}
+	if runs := n.step(); !reflect.DeepEqual(runs, []string{"a"}) {
+		t.Fatalf("runs %v", runs)
+	}
+
+	// a goes down as the job fires, the lease of a expires after three
+	// heartbeats, b claims the job and holds it a heartbeat later
+	a.down = true
+	var got [][]string
+	for i := 0; i < 7; i++ {
+		got = append(got, n.step())
+	}
+	want := [][]string{nil, nil, nil, nil, {"b"}, {"b"}, {"b"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("runs %v, want %v", got, want)
+	}
+}
+
+func TestSingletonLeave(t *testing.T) {
+	n := newTestNet(t, jobName("a", "b"))
+	defer n.destroy()
+	a := n.join("a")
+	b := n.join("b")
+	for i := 0; i < 5; i++ {
+		n.step()
+	}
+	if owner := b.c.Owner(n.name); owner != "a" {
+		t.Fatalf("owner %v", owner)
+	}
+
+	// the job is released before the peers learn about the leave
+	a.c.leave()
+	if a.c.IsOwner(n.name) {
+		t.Fatal("a still owns the job")
+	}
+	b.c.handle(&message{Leave: "a"})
+	a.down = true
+
+	var got [][]string
+	for i := 0; i < 3; i++ {
+		got = append(got, n.step())
+	}
+	want := [][]string{nil, nil, {"b"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("runs %v, want %v", got, want)
+	}
+}
@@ -1,5 +1,7 @@
 package conf
 
+import "time"
+
 var (
 	LenStackBuf = 4096
 
@@ -14,7 +16,14 @@ var (
 	ProfilePath   string
 
 	// cluster
+	NodeID          string
 	ListenAddr      string
 	ConnAddrs       []string
 	PendingWriteNum int
+
+	// shutdown, 0 means no deadline
+	StopTimeout    time.Duration
+	NotifyTimeout  time.Duration
+	DrainTimeout   time.Duration
+	DestroyTimeout time.Duration
 )
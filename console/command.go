@@ -1,6 +1,7 @@
 package console
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/shinjuwu/leaf/chanrpc"
 	"github.com/shinjuwu/leaf/conf"
@@ -8,15 +9,11 @@ import (
 	"os"
 	"path"
 	"runtime/pprof"
+	"strings"
+	"text/tabwriter"
 	"time"
 )
 
-var commands = []Command{
-	new(CommandHelp),
-	new(CommandCPUProf),
-	new(CommandProf),
-}
-
 type Command interface {
 	// must goroutine safe
 	name() string
@@ -61,23 +58,96 @@ func (c *ExternalCommand) run(_args []string) string {
 // you must call the function before calling console.Init
 // goroutine not safe
 func Register(name string, help string, f interface{}, server *chanrpc.Server) {
-	for _, c := range commands {
-		if c.name() == name {
-			log.Fatal("command %v is already registered", name)
-		}
-	}
+	std.Register(name, help, f, server)
+}
 
+// goroutine safe
+func (console *Console) Register(name string, help string, f interface{}, server *chanrpc.Server) {
 	server.Register(name, f)
 
 	c := new(ExternalCommand)
 	c._name = name
 	c._help = help
 	c.server = server
-	commands = append(commands, c)
+	console.register(c)
+}
+
+// f is called on the console goroutine
+// goroutine safe
+func (console *Console) RegisterFunc(name string, help string, f func(args []string) string) {
+	c := new(FuncCommand)
+	c._name = name
+	c._help = help
+	c.f = f
+	console.register(c)
+}
+
+func (console *Console) register(c Command) {
+	console.mutex.Lock()
+	defer console.mutex.Unlock()
+
+	for _, _c := range console.commands {
+		if _c.name() == c.name() {
+			log.Fatal("command %v is already registered", c.name())
+		}
+	}
+	console.commands = append(console.commands, c)
+}
+
+// goroutine safe
+func (console *Console) Unregister(name string) {
+	console.mutex.Lock()
+	defer console.mutex.Unlock()
+
+	for i, c := range console.commands {
+		if c.name() == name {
+			console.commands = append(console.commands[:i:i], console.commands[i+1:]...)
+			return
+		}
+	}
+}
+
+func (console *Console) command(name string) Command {
+	console.mutex.RLock()
+	defer console.mutex.RUnlock()
+
+	for _, c := range console.commands {
+		if c.name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (console *Console) commandList() []Command {
+	console.mutex.RLock()
+	defer console.mutex.RUnlock()
+
+	return console.commands
+}
+
+type FuncCommand struct {
+	_name string
+	_help string
+	f     func(args []string) string
+}
+
+func (c *FuncCommand) name() string {
+	return c._name
+}
+
+func (c *FuncCommand) help() string {
+	return c._help
+}
+
+func (c *FuncCommand) run(args []string) string {
+	return c.f(args)
 }
 
 // help
-type CommandHelp struct{}
+type CommandHelp struct {
+	console *Console
+}
 
 func (c *CommandHelp) name() string {
 	return "help"
@@ -89,7 +159,7 @@ func (c *CommandHelp) help() string {
 
 func (c *CommandHelp) run([]string) string {
 	output := "Commands:\r\n"
-	for _, c := range commands {
+	for _, c := range c.console.commandList() {
 		output += c.name() + " - " + c.help() + "\r\n"
 	}
 	output += "quit - exit console"
@@ -213,3 +283,125 @@ func (c *CommandProf) run(args []string) string {
 
 	return fn
 }
+
+// rpcstat
+type chanRPCStat struct {
+	name   string
+	server *chanrpc.Server
+	client *chanrpc.Client
+}
+
+// you must call the function before calling console.Init
+// goroutine not safe
+func RegisterChanRPC(name string, server *chanrpc.Server, client *chanrpc.Client) {
+	std.RegisterChanRPC(name, server, client)
+}
+
+// goroutine safe
+func (console *Console) RegisterChanRPC(name string, server *chanrpc.Server, client *chanrpc.Client) {
+	console.mutex.Lock()
+	defer console.mutex.Unlock()
+
+	for _, s := range console.chanRPCStats {
+		if s.name == name {
+			log.Fatal("chanrpc %v is already registered", name)
+		}
+	}
+
+	s := new(chanRPCStat)
+	s.name = name
+	s.server = server
+	s.client = client
+	console.chanRPCStats = append(console.chanRPCStats, s)
+}
+
+// goroutine safe
+func (console *Console) UnregisterChanRPC(name string) {
+	console.mutex.Lock()
+	defer console.mutex.Unlock()
+
+	for i, s := range console.chanRPCStats {
+		if s.name == name {
+			console.chanRPCStats = append(console.chanRPCStats[:i:i], console.chanRPCStats[i+1:]...)
+			return
+		}
+	}
+}
+
+func (console *Console) chanRPCStatList() []*chanRPCStat {
+	console.mutex.RLock()
+	defer console.mutex.RUnlock()
+
+	return console.chanRPCStats
+}
+
+type CommandRPCStat struct {
+	console *Console
+}
+
+func (c *CommandRPCStat) name() string {
+	return "rpcstat"
+}
+
+func (c *CommandRPCStat) help() string {
+	return "chanrpc statistics of the modules"
+}
+
+func (c *CommandRPCStat) usage() string {
+	return "Usage: rpcstat [module]\r\n" +
+		"  without module - queue length and dropped calls of every module\r\n" +
+		"  module         - calls, errors and latency per function id"
+}
+
+func (c *CommandRPCStat) run(args []string) string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+
+	if len(args) == 0 {
+		fmt.Fprintln(w, "module\tqueue\tpriority\tpending\tdropped")
+		for _, s := range c.console.chanRPCStatList() {
+			fmt.Fprintf(w, "%v\t%v/%v\t%v/%v\t%v\t%v\n",
+				s.name, len(s.server.ChanCall), cap(s.server.ChanCall),
+				len(s.server.ChanPriorityCall), cap(s.server.ChanPriorityCall), s.client.Pending(),
+				s.server.Dropped(chanrpc.DropUnregistered)+
+					s.server.Dropped(chanrpc.DropClosed)+
+					s.server.Dropped(chanrpc.DropFull))
+		}
+		w.Flush()
+		return strings.Replace(strings.TrimSuffix(buf.String(), "\n"), "\n", "\r\n", -1)
+	}
+
+	var stat *chanRPCStat
+	for _, s := range c.console.chanRPCStatList() {
+		if s.name == args[0] {
+			stat = s
+			break
+		}
+	}
+	if stat == nil {
+		return c.usage()
+	}
+
+	fmt.Fprintf(w, "queue: %v/%v, priority: %v/%v, pending: %v\n",
+		len(stat.server.ChanCall), cap(stat.server.ChanCall),
+		len(stat.server.ChanPriorityCall), cap(stat.server.ChanPriorityCall), stat.client.Pending())
+	fmt.Fprintf(w, "dropped: %v %v, %v %v, %v %v\n",
+		chanrpc.DropUnregistered, stat.server.Dropped(chanrpc.DropUnregistered),
+		chanrpc.DropClosed, stat.server.Dropped(chanrpc.DropClosed),
+		chanrpc.DropFull, stat.server.Dropped(chanrpc.DropFull))
+	fmt.Fprint(w, "id\tcalls\terrors\tpanics\tavg\tmax")
+	for _, b := range chanrpc.LatencyBuckets {
+		fmt.Fprintf(w, "\t<%v", b)
+	}
+	fmt.Fprintf(w, "\t>=%v\n", chanrpc.LatencyBuckets[len(chanrpc.LatencyBuckets)-1])
+	for _, fs := range stat.server.Stats() {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v",
+			fs.ID, fs.Calls, fs.Errors, fs.Panics, fs.Avg(), fs.Max)
+		for _, n := range fs.Latency {
+			fmt.Fprintf(w, "\t%v", n)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+	return strings.Replace(strings.TrimSuffix(buf.String(), "\n"), "\n", "\r\n", -1)
+}
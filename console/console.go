@@ -7,37 +7,78 @@ import (
 	"math"
 	"strconv"
 	"strings"
+	"sync"
 )
 
-var server *network.TCPServer
+type Console struct {
+	Port         int
+	Prompt       string
+	commands     []Command
+	chanRPCStats []*chanRPCStat
+	mutex        sync.RWMutex
+	server       *network.TCPServer
+}
+
+var std = New()
+
+// the console used by the package level functions
+func Default() *Console {
+	return std
+}
+
+func New() *Console {
+	c := new(Console)
+	c.Prompt = "Leaf# "
+	c.commands = []Command{
+		&CommandHelp{c},
+		new(CommandCPUProf),
+		new(CommandProf),
+		&CommandRPCStat{c},
+	}
+	return c
+}
 
 func Init() {
-	if conf.ConsolePort == 0 {
+	std.Port = conf.ConsolePort
+	std.Prompt = conf.ConsolePrompt
+	std.Init()
+}
+
+func Destroy() {
+	std.Destroy()
+}
+
+func (c *Console) Init() {
+	if c.Port == 0 {
 		return
 	}
 
-	server = new(network.TCPServer)
-	server.Addr = "localhost:" + strconv.Itoa(conf.ConsolePort)
-	server.MaxConnNum = int(math.MaxInt32)
-	server.PendingWriteNum = 100
-	server.NewAgent = newAgent
+	c.server = new(network.TCPServer)
+	c.server.Addr = "localhost:" + strconv.Itoa(c.Port)
+	c.server.MaxConnNum = int(math.MaxInt32)
+	c.server.PendingWriteNum = 100
+	c.server.NewAgent = func(conn *network.TCPConn) network.Agent {
+		return newAgent(c, conn)
+	}
 
-	server.Start()
+	c.server.Start()
 }
 
-func Destroy() {
-	if server != nil {
-		server.Close()
+func (c *Console) Destroy() {
+	if c.server != nil {
+		c.server.Close()
 	}
 }
 
 type Agent struct {
-	conn   *network.TCPConn
-	reader *bufio.Reader
+	console *Console
+	conn    *network.TCPConn
+	reader  *bufio.Reader
 }
 
-func newAgent(conn *network.TCPConn) network.Agent {
+func newAgent(console *Console, conn *network.TCPConn) network.Agent {
 	a := new(Agent)
+	a.console = console
 	a.conn = conn
 	a.reader = bufio.NewReader(conn)
 	return a
@@ -45,8 +86,8 @@ func newAgent(conn *network.TCPConn) network.Agent {
 
 func (a *Agent) Run() {
 	for {
-		if conf.ConsolePrompt != "" {
-			a.conn.Write([]byte(conf.ConsolePrompt))
+		if a.console.Prompt != "" {
+			a.conn.Write([]byte(a.console.Prompt))
 		}
 
 		line, err := a.reader.ReadString('\n')
@@ -62,13 +103,7 @@ func (a *Agent) Run() {
 		if args[0] == "quit" {
 			break
 		}
-		var c Command
-		for _, _c := range commands {
-			if _c.name() == args[0] {
-				c = _c
-				break
-			}
-		}
+		c := a.console.command(args[0])
 		if c == nil {
 			a.conn.Write([]byte("command not found, try `help` for help\r\n"))
 			continue
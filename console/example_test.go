@@ -0,0 +1,38 @@
+package console
+
+import (
+	"fmt"
+	"github.com/shinjuwu/leaf/chanrpc"
+	"strings"
+)
+
+func ExampleCommandRPCStat() {
+	c := New()
+	s := chanrpc.NewServer(10)
+	c.RegisterChanRPC("game", s, s.Open(10))
+
+	s.Register("login", func(args []interface{}) {})
+	s.EnablePriority()
+	s.Go("login")
+	s.Go("login")
+	s.GoPriority("login")
+	s.Go("logout")
+	s.Exec(<-s.ChanCall)
+
+	cmd := c.command("rpcstat")
+	fmt.Println(strings.Replace(cmd.run(nil), "\r\n", "\n", -1))
+
+	// the latency columns vary
+	lines := strings.Split(cmd.run([]string{"game"}), "\r\n")
+	for _, l := range lines[:2] {
+		fmt.Println(l)
+	}
+	fmt.Println(strings.Fields(lines[3])[:4])
+
+	// Output:
+	// module  queue  priority  pending  dropped
+	// game    1/10   1/10      0        1
+	// queue: 1/10, priority: 1/10, pending: 0
+	// dropped: unregistered 1, closed 0, full 0
+	// [login 1 0 0]
+}
@@ -29,7 +29,7 @@ func (a *agent) Run() {
 			break
 		}
 		if a.GetSession() == nil {
-			a.session, err = NewSessionByMap(a.gate.AgentChanRPC, map[string]interface{}{
+			a.session, err = a.gate.NewSessionByMap(map[string]interface{}{
 				"Sessionid": util.GenerateID().String(),
 				"Network":   a.conn.RemoteAddr().Network(),
 				"IP":        a.conn.RemoteAddr().String(),
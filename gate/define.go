@@ -112,5 +112,6 @@ type GateHandler interface {
 	Close(args []interface{}) interface{}             //主动关闭连接
 	Update(args []interface{}) interface{}            //更新整个Session 通常是其他模块拉取最新数据
 	OnDestory()                                       //退出事件,主动关闭所有的连接
+	Agents() []Agent                                  //当前所有的连接
 	CloseMultiSession(args []interface{}) interface{} //關閉重複登入的連線
 }
@@ -1,6 +1,7 @@
 package gate
 
 import (
+	"sync"
 	"time"
 
 	"github.com/shinjuwu/leaf/chanrpc"
@@ -13,6 +14,9 @@ type Gate struct {
 	MaxMsgLen       uint32
 	Processor       network.Processor
 	AgentChanRPC    *chanrpc.Server
+	RPCTimeout      time.Duration
+	//关服时通知每个连接
+	NotifyShutdown func(a Agent)
 
 	// websocket
 	WSAddr      string
@@ -31,9 +35,20 @@ type Gate struct {
 	sessionLearner SessionLearner
 	storage        StorageHandler
 	//tracing        TracingHandler
+
+	servers *servers
+}
+
+// started by Run, the listeners are closed by OnStop
+type servers struct {
+	sync.Mutex
+	stopped bool
+	ws      *network.WSServer
+	tcp     *network.TCPServer
 }
 
 func (gate *Gate) OnInit() {
+	gate.servers = new(servers)
 	handler := NewGateHandler(*gate)
 
 	gate.agentLearner = handler
@@ -90,12 +105,21 @@ func (gate *Gate) Run(closeSig chan bool) {
 		}
 	}
 
+	gate.servers.Lock()
+	if gate.servers.stopped {
+		wsServer = nil
+		tcpServer = nil
+	}
 	if wsServer != nil {
 		wsServer.Start()
 	}
 	if tcpServer != nil {
 		tcpServer.Start()
 	}
+	gate.servers.ws = wsServer
+	gate.servers.tcp = tcpServer
+	gate.servers.Unlock()
+
 	<-closeSig
 	if wsServer != nil {
 		wsServer.Close()
@@ -108,6 +132,30 @@ func (gate *Gate) Run(closeSig chan bool) {
 func (gate *Gate) OnDestroy() {
 }
 
+//关服: 停止接受新连接
+func (gate *Gate) OnStop() {
+	gate.servers.Lock()
+	defer gate.servers.Unlock()
+
+	gate.servers.stopped = true
+	if gate.servers.ws != nil {
+		gate.servers.ws.CloseListener()
+	}
+	if gate.servers.tcp != nil {
+		gate.servers.tcp.CloseListener()
+	}
+}
+
+//关服: 通知所有连接
+func (gate *Gate) OnNotify() {
+	if gate.NotifyShutdown == nil || gate.handler == nil {
+		return
+	}
+	for _, a := range gate.handler.Agents() {
+		gate.NotifyShutdown(a)
+	}
+}
+
 func (this *Gate) GetStorageHandler() (storage StorageHandler) {
 	return this.storage
 }
@@ -121,7 +169,21 @@ func (this *Gate) SetStorageHandler(storage StorageHandler) error {
 }
 
 func (this *Gate) NewSession(data []byte) (Session, error) {
-	return NewSession(this.AgentChanRPC, data)
+	session, err := NewSession(this.AgentChanRPC, data)
+	if err != nil {
+		return nil, err
+	}
+	session.(*sessionagent).timeout = this.RPCTimeout
+	return session, nil
+}
+
+func (this *Gate) NewSessionByMap(data map[string]interface{}) (Session, error) {
+	session, err := NewSessionByMap(this.AgentChanRPC, data)
+	if err != nil {
+		return nil, err
+	}
+	session.(*sessionagent).timeout = this.RPCTimeout
+	return session, nil
 }
 
 /**
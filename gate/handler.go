@@ -28,6 +28,15 @@ func (h *handler) OnDestory() {
 	h.sessions.DeleteAll()
 }
 
+func (h *handler) Agents() []Agent {
+	items := h.sessions.Items()
+	agents := make([]Agent, 0, len(items))
+	for _, v := range items {
+		agents = append(agents, v.(Agent))
+	}
+	return agents
+}
+
 //Update : f(sessionID string) error
 func (h *handler) Update(args []interface{}) interface{} {
 	sessionID := args[0].(string)
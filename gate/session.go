@@ -1,7 +1,9 @@
 package gate
 
 import (
+	"context"
 	fmt "fmt"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/shinjuwu/leaf/chanrpc"
@@ -9,6 +11,7 @@ import (
 
 type sessionagent struct {
 	AgentChanRPC *chanrpc.Server
+	timeout      time.Duration
 	session      *SessionImp
 	judgeGuest   func(session Session) bool
 }
@@ -36,6 +39,36 @@ func NewSessionByMap(chanRpc *chanrpc.Server, data map[string]interface{}) (Sess
 	return agent, nil
 }
 
+//调用AgentChanRPC,超过timeout未返回则放弃等待
+func (this *sessionagent) call0(id interface{}, args ...interface{}) error {
+	if this.timeout <= 0 {
+		return this.AgentChanRPC.Call0(id, args...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), this.timeout)
+	defer cancel()
+	return this.AgentChanRPC.Call0Ctx(ctx, id, args...)
+}
+
+func (this *sessionagent) call1(id interface{}, args ...interface{}) (interface{}, error) {
+	if this.timeout <= 0 {
+		return this.AgentChanRPC.Call1(id, args...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), this.timeout)
+	defer cancel()
+	return this.AgentChanRPC.Call1Ctx(ctx, id, args...)
+}
+
+//控制类调用走优先通道,不会被大量客户端消息阻塞
+func (this *sessionagent) callPriority(id interface{}, args ...interface{}) (interface{}, error) {
+	ctx := context.Background()
+	if this.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, this.timeout)
+		defer cancel()
+	}
+	return this.AgentChanRPC.CallPriority(ctx, id, args...)
+}
+
 func (this *sessionagent) GetIP() string {
 	return this.session.GetIP()
 }
@@ -136,7 +169,7 @@ func (this *sessionagent) Update() (err error) {
 		err = fmt.Errorf("AgentChanRPC is nil")
 		return
 	}
-	result, err := this.AgentChanRPC.Call1("Update", this.session.Sessionid)
+	result, err := this.callPriority("Update", this.session.Sessionid)
 	if err == nil {
 		if result != nil {
 			//绑定成功,重新更新当前Session
@@ -151,7 +184,7 @@ func (this *sessionagent) Bind(userid string) string {
 		return "AgentChanRPC is nil"
 	}
 
-	result, err := this.AgentChanRPC.Call1("Bind", this.session.Sessionid, userid)
+	result, err := this.callPriority("Bind", this.session.Sessionid, userid)
 	if err == nil {
 		if result != nil {
 			//绑定成功,重新更新当前Session
@@ -165,7 +198,7 @@ func (this *sessionagent) UnBind() string {
 	if this.AgentChanRPC == nil {
 		return "AgentChanRPC is nil"
 	}
-	result, err := this.AgentChanRPC.Call1("Unbind", this.session.Sessionid)
+	result, err := this.callPriority("Unbind", this.session.Sessionid)
 	if err == nil {
 		if result != nil {
 			//绑定成功,重新更新当前Session
@@ -180,7 +213,7 @@ func (this *sessionagent) Push() string {
 		return "AgentChanRPC is nil"
 	}
 
-	result, err := this.AgentChanRPC.Call1("Push", this.session.Sessionid, this.session.Settings)
+	result, err := this.callPriority("Push", this.session.Sessionid, this.session.Settings)
 	if err == nil {
 		if result != nil {
 			//绑定成功,重新更新当前Session
@@ -232,7 +265,7 @@ func (this *sessionagent) Send(id string, data interface{}) string {
 	if this.AgentChanRPC == nil {
 		return "AgentChanRPC is nil"
 	}
-	_, err := this.AgentChanRPC.Call1("Send", this.session.Sessionid, data)
+	_, err := this.call1("Send", this.session.Sessionid, data)
 	if err != nil {
 		return err.Error()
 	}
@@ -244,7 +277,7 @@ func (this *sessionagent) SendBatch(Sessionids string, data interface{}) string
 		return "AgentChanRPC is nil"
 	}
 
-	_, err := this.AgentChanRPC.Call1("SendBatch", Sessionids, data)
+	_, err := this.call1("SendBatch", Sessionids, data)
 	if err != nil {
 		return err.Error()
 	}
@@ -255,7 +288,7 @@ func (this *sessionagent) IsConnect(userId string) (bool, string) {
 	if this.AgentChanRPC == nil {
 		return false, "AgentChanRPC is nil"
 	}
-	result, err := this.AgentChanRPC.Call1("IsConnect", userId)
+	result, err := this.callPriority("IsConnect", userId)
 	if err != nil {
 		return false, err.Error()
 	}
@@ -266,7 +299,7 @@ func (this *sessionagent) SendNR(id string, data interface{}) string {
 	if this.AgentChanRPC == nil {
 		return "AgentChanRPC is nil"
 	}
-	err := this.AgentChanRPC.Call0("Send", this.session.Sessionid, data)
+	err := this.call0("Send", this.session.Sessionid, data)
 	if err != nil {
 		return err.Error()
 	}
@@ -277,7 +310,7 @@ func (this *sessionagent) Close() error {
 	if this.AgentChanRPC == nil {
 		return fmt.Errorf("AgentChanRPC is nil")
 	}
-	_, err := this.AgentChanRPC.Call1("Close", this.session.Sessionid)
+	_, err := this.callPriority("Close", this.session.Sessionid)
 	return err
 }
 
@@ -302,7 +335,7 @@ func (this *sessionagent) CloseMultiSession(key string) string {
 	if this.AgentChanRPC == nil {
 		return "AgentChanRPC is nil"
 	}
-	_, err := this.AgentChanRPC.Call1("CloseMultiSession", key)
+	_, err := this.callPriority("CloseMultiSession", key)
 	if err != nil {
 		return err.Error()
 	}
@@ -1,6 +1,8 @@
 package g_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/shinjuwu/leaf/go"
 	"time"
@@ -68,3 +70,165 @@ func ExampleLinearContext() {
 	// 1
 	// 2
 }
+
+func ExampleGo_SetPool() {
+	d := g.New(10)
+	d.SetPool(1, 1, g.RejectDiscard)
+
+	// the worker is busy with the first function,
+	// the second one waits in the queue, the third one is discarded
+	running := make(chan bool)
+	start := make(chan bool)
+	d.Go(func() {
+		running <- true
+		<-start
+	}, func() {
+		fmt.Println("1")
+	})
+	<-running
+	d.Go(func() {}, func() {
+		fmt.Println("2")
+	})
+	d.Go(func() {}, func() {
+		fmt.Println("3")
+	})
+	fmt.Println("rejected", d.Rejected(), "discarded", d.Discarded())
+
+	close(start)
+	d.Cb(<-d.ChanCb)
+	d.Cb(<-d.ChanCb)
+
+	// cancelled by Close
+	d.GoCtx(func(ctx context.Context) {
+		<-ctx.Done()
+		fmt.Println(ctx.Err())
+	}, nil)
+
+	d.Close()
+
+	// the workers are stopped
+	d.Go(func() {}, func() {
+		fmt.Println("4")
+	})
+	fmt.Println("discarded", d.Discarded())
+
+	// Output:
+	// rejected 1 discarded 1
+	// 1
+	// 2
+	// context canceled
+	// discarded 2
+}
+
+func ExampleGo_SetPool_block() {
+	// the worker waits for the caller to receive each callback
+	d := g.New(0)
+	d.SetPool(1, 1, g.RejectBlock)
+
+	running := make(chan bool)
+	start := make(chan bool)
+	d.Go(func() {
+		running <- true
+	}, func() {
+		fmt.Println("callback 1")
+	})
+	<-running
+	d.Go(func() {
+		<-start
+	}, func() {
+		fmt.Println("callback 2")
+	})
+
+	// the queue is full, Go runs the callback of the first function
+	// while it waits
+	d.Go(func() {}, func() {
+		fmt.Println("callback 3")
+	})
+	fmt.Println("queued, rejected", d.Rejected())
+
+	close(start)
+	d.Close()
+
+	// Output:
+	// callback 1
+	// queued, rejected 1
+	// callback 2
+	// callback 3
+}
+
+func ExampleKeyedContext() {
+	d := g.New(10)
+	c := d.NewKeyedContext(2)
+
+	// in order per key, in parallel across keys
+	var user1, user2 []int
+	for i := 0; i < 3; i++ {
+		i := i
+		c.Go("user1", func() {
+			time.Sleep(time.Millisecond)
+			user1 = append(user1, i)
+		}, nil)
+		c.Go("user2", func() {
+			user2 = append(user2, i)
+		}, nil)
+	}
+
+	d.Close()
+	fmt.Println(user1, user2)
+
+	// Output:
+	// [0 1 2] [0 1 2]
+}
+
+func ExampleGo_GoResult() {
+	d := g.New(10)
+
+	d.GoResult(func() (interface{}, error) {
+		return 1 + 1, nil
+	}, func(ret interface{}, err error) {
+		fmt.Println(ret, err)
+	})
+	d.Cb(<-d.ChanCb)
+
+	d.GoResult(func() (interface{}, error) {
+		return nil, errors.New("not found")
+	}, func(ret interface{}, err error) {
+		fmt.Println(ret, err)
+	})
+	d.Cb(<-d.ChanCb)
+
+	d.GoResult(func() (interface{}, error) {
+		var m map[string]int
+		m["key"] = 1
+		return nil, nil
+	}, func(ret interface{}, err error) {
+		fmt.Println(ret, err)
+	})
+	d.Cb(<-d.ChanCb)
+
+	// the worker is busy, the queue is full
+	p := g.New(10)
+	p.SetPool(1, 1, g.RejectDiscard)
+	running := make(chan bool)
+	start := make(chan bool)
+	p.Go(func() {
+		running <- true
+		<-start
+	}, nil)
+	<-running
+	p.Go(func() {}, nil)
+	p.GoResult(func() (interface{}, error) {
+		return 1, nil
+	}, func(ret interface{}, err error) {
+		fmt.Println(ret, err)
+	})
+
+	close(start)
+	p.Close()
+
+	// Output:
+	// 2 <nil>
+	// <nil> not found
+	// <nil> assignment to entry in nil map
+	// <nil> go function rejected
+}
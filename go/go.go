@@ -2,16 +2,49 @@ package g
 
 import (
 	"container/list"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/shinjuwu/leaf/conf"
 	"github.com/shinjuwu/leaf/log"
 	"runtime"
 	"sync"
+	"sync/atomic"
 )
 
+// the error of GoResult when f is discarded
+var ErrRejected = errors.New("go function rejected")
+
 // one Go per goroutine (goroutine not safe)
 type Go struct {
 	ChanCb    chan func()
 	pendingGo int
+	ctx       context.Context
+	cancel    context.CancelFunc
+	queue     chan *task
+	reject    RejectPolicy
+	rejected  int64
+	discarded int64
+	keyed     *KeyedContext
+}
+
+// what Go does when the queue of the worker pool is full
+type RejectPolicy int
+
+const (
+	// the caller waits for room in the queue. the callbacks of the finished
+	// functions run meanwhile, inside the call to Go, so that the workers
+	// are not blocked on a full ChanCb
+	RejectBlock RejectPolicy = iota
+	// f runs on the calling goroutine
+	RejectCallerRuns
+	// f and cb are dropped, the cb of GoResult receives ErrRejected
+	RejectDiscard
+)
+
+type task struct {
+	f  func(ctx context.Context)
+	cb func()
 }
 
 type LinearGo struct {
@@ -29,16 +62,84 @@ type LinearContext struct {
 func New(l int) *Go {
 	g := new(Go)
 	g.ChanCb = make(chan func(), l)
+	g.ctx, g.cancel = context.WithCancel(context.Background())
 	return g
 }
 
+// the functions run on workers goroutines, at most queueLen functions wait
+// for a worker. the functions started after Close are discarded.
+// you must call the function before calling Go
+func (g *Go) SetPool(workers int, queueLen int, reject RejectPolicy) {
+	g.queue = make(chan *task, queueLen)
+	g.reject = reject
+	for i := 0; i < workers; i++ {
+		go g.work()
+	}
+}
+
 func (g *Go) Go(f func(), cb func()) {
+	g.GoCtx(func(context.Context) {
+		f()
+	}, cb)
+}
+
+// ctx is cancelled by Close
+func (g *Go) GoCtx(f func(ctx context.Context), cb func()) {
+	g.goCtx(f, cb)
+}
+
+// returns false if f and cb are discarded
+func (g *Go) goCtx(f func(ctx context.Context), cb func()) bool {
 	g.pendingGo++
 
-	go func() {
+	if g.queue == nil {
+		go g.exec(f, cb)
+		return true
+	}
+	// the workers are stopped
+	if g.ctx.Err() != nil {
+		g.pendingGo--
+		atomic.AddInt64(&g.discarded, 1)
+		return false
+	}
+
+	t := &task{f: f, cb: cb}
+	select {
+	case g.queue <- t:
+		return true
+	default:
+	}
+
+	atomic.AddInt64(&g.rejected, 1)
+	switch g.reject {
+	case RejectCallerRuns:
+		g.call(f)
+		g.Cb(cb)
+	case RejectDiscard:
+		g.pendingGo--
+		atomic.AddInt64(&g.discarded, 1)
+		return false
+	default:
+		for {
+			select {
+			case g.queue <- t:
+				return true
+			case cb := <-g.ChanCb:
+				g.Cb(cb)
+			}
+		}
+	}
+	return true
+}
+
+// cb receives the result of f, a panic in f becomes the error
+func (g *Go) GoResult(f func() (interface{}, error), cb func(ret interface{}, err error)) {
+	var ret interface{}
+	var err error
+	ok := g.goCtx(func(context.Context) {
 		defer func() {
-			g.ChanCb <- cb
 			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
 				if conf.LenStackBuf > 0 {
 					buf := make([]byte, conf.LenStackBuf)
 					l := runtime.Stack(buf, false)
@@ -49,8 +150,72 @@ func (g *Go) Go(f func(), cb func()) {
 			}
 		}()
 
-		f()
+		ret, err = f()
+	}, func() {
+		if cb != nil {
+			cb(ret, err)
+		}
+	})
+	if !ok && cb != nil {
+		g.pendingGo++
+		g.Cb(func() {
+			cb(nil, ErrRejected)
+		})
+	}
+}
+
+// the number of functions which found the queue full, whatever the policy.
+// goroutine safe
+func (g *Go) Rejected() int64 {
+	return atomic.LoadInt64(&g.rejected)
+}
+
+// the number of functions dropped by RejectDiscard or after Close.
+// goroutine safe
+func (g *Go) Discarded() int64 {
+	return atomic.LoadInt64(&g.discarded)
+}
+
+func (g *Go) work() {
+	for {
+		select {
+		case t := <-g.queue:
+			g.exec(t.f, t.cb)
+		case <-g.ctx.Done():
+			for {
+				select {
+				case t := <-g.queue:
+					g.exec(t.f, t.cb)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (g *Go) exec(f func(ctx context.Context), cb func()) {
+	defer func() {
+		g.ChanCb <- cb
 	}()
+
+	g.call(f)
+}
+
+func (g *Go) call(f func(ctx context.Context)) {
+	defer func() {
+		if r := recover(); r != nil {
+			if conf.LenStackBuf > 0 {
+				buf := make([]byte, conf.LenStackBuf)
+				l := runtime.Stack(buf, false)
+				log.Error("%v: %s", r, buf[:l])
+			} else {
+				log.Error("%v", r)
+			}
+		}
+	}()
+
+	f(g.ctx)
 }
 
 func (g *Go) Cb(cb func()) {
@@ -72,7 +237,9 @@ func (g *Go) Cb(cb func()) {
 	}
 }
 
+// the context of the running functions is cancelled
 func (g *Go) Close() {
+	g.cancel()
 	for g.pendingGo > 0 {
 		g.Cb(<-g.ChanCb)
 	}
@@ -0,0 +1,91 @@
+package g
+
+import (
+	"container/list"
+	"context"
+	"runtime"
+	"sync"
+)
+
+// a KeyedContext runs the functions of the same key in order and
+// the functions of different keys in parallel, on at most n goroutines.
+// the goroutines are started on demand and exit when there is no work
+type KeyedContext struct {
+	g       *Go
+	n       int
+	mutex   sync.Mutex
+	queues  map[interface{}]*list.List
+	ready   *list.List
+	workers int
+}
+
+func (g *Go) NewKeyedContext(n int) *KeyedContext {
+	if n <= 0 {
+		n = 1
+	}
+
+	c := new(KeyedContext)
+	c.g = g
+	c.n = n
+	c.queues = make(map[interface{}]*list.List)
+	c.ready = list.New()
+	return c
+}
+
+// the functions run on a KeyedContext of runtime.NumCPU() goroutines
+func (g *Go) GoKeyed(key interface{}, f func(), cb func()) {
+	if g.keyed == nil {
+		g.keyed = g.NewKeyedContext(runtime.NumCPU())
+	}
+	g.keyed.Go(key, f, cb)
+}
+
+func (c *KeyedContext) Go(key interface{}, f func(), cb func()) {
+	c.g.pendingGo++
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	q := c.queues[key]
+	if q == nil {
+		// the key is neither ready nor running
+		q = list.New()
+		c.queues[key] = q
+		c.ready.PushBack(key)
+	}
+	q.PushBack(&LinearGo{f: f, cb: cb})
+
+	if c.workers < c.n {
+		c.workers++
+		go c.work()
+	}
+}
+
+// a key taken from ready is run by one worker only,
+// it goes back to the tail of ready after one function
+func (c *KeyedContext) work() {
+	for {
+		c.mutex.Lock()
+		if c.ready.Len() == 0 {
+			c.workers--
+			c.mutex.Unlock()
+			return
+		}
+		key := c.ready.Remove(c.ready.Front())
+		q := c.queues[key]
+		e := q.Remove(q.Front()).(*LinearGo)
+		c.mutex.Unlock()
+
+		c.g.exec(func(context.Context) {
+			e.f()
+		}, e.cb)
+
+		c.mutex.Lock()
+		if q.Len() == 0 {
+			delete(c.queues, key)
+		} else {
+			c.ready.PushBack(key)
+		}
+		c.mutex.Unlock()
+	}
+}
@@ -1,8 +1,10 @@
 package leaf
 
 import (
+	"context"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/shinjuwu/leaf/cluster"
 	"github.com/shinjuwu/leaf/conf"
@@ -24,24 +26,24 @@ func Run(mods ...module.Module) {
 
 	log.Release("Leaf %v starting up", version)
 
-	// module
-	for i := 0; i < len(mods); i++ {
-		module.Register(mods[i])
+	app := newApp(module.Default(), console.Default(), cluster.Default())
+	if err := app.Start(mods...); err != nil {
+		log.Fatal("%v", err)
 	}
-	module.Init()
-
-	// cluster
-	cluster.Init()
-
-	// console
-	console.Init()
 
 	// close
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	sig := <-c
 	log.Release("Leaf closing down (signal: %v)", sig)
-	console.Destroy()
-	cluster.Destroy()
-	module.Destroy()
+
+	// a second signal forces the exit
+	go func() {
+		sig := <-c
+		log.Fatal("Leaf forced to exit (signal: %v)", sig)
+	}()
+
+	if err := app.Stop(context.Background()); err != nil {
+		log.Fatal("%v", err)
+	}
 }
@@ -0,0 +1,341 @@
+package module
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/shinjuwu/leaf/conf"
+	"github.com/shinjuwu/leaf/log"
+	"github.com/shinjuwu/leaf/timer"
+)
+
+// an Entity is the state of an actor, the actor is created with the
+// entity on the first message sent to its key
+type Entity interface {
+	OnCreate(a *Actor)
+	// called when the actor is stopped, passivated or the system is closed
+	OnDestroy(a *Actor)
+}
+
+// an ActorSystem multiplexes actors on a Skeleton.
+// an actor registers its handlers in OnCreate, the handlers registered
+// on the ActorSystem are used by the actors without their own.
+// the messages of an actor are processed serially, on the skeleton goroutine
+// if Workers is 0, otherwise on at most Workers goroutines at the same time
+// (GoLen of the skeleton must be set).
+// an actor without messages for IdleTimeout is passivated
+// (TimerDispatcherLen of the skeleton must be set), the idle actors are
+// checked every IdleTimeout/2 but at most every millisecond.
+// the ActorSystem is goroutine not safe, use it on the skeleton goroutine
+type ActorSystem struct {
+	Workers     int
+	IdleTimeout time.Duration
+	skeleton    *Skeleton
+	newEntity   func(key interface{}) Entity
+	handlers    map[interface{}]func(a *Actor, args []interface{})
+	actors      map[interface{}]*Actor
+	ready       []*Actor
+	running     int
+	dispatching bool
+	sweep       *timer.Timer
+}
+
+type message struct {
+	id   interface{}
+	args []interface{}
+}
+
+// an Actor is goroutine not safe, its methods can only be called
+// in its handlers and entity hooks
+type Actor struct {
+	key        interface{}
+	entity     Entity
+	system     *ActorSystem
+	mailbox    []message
+	scheduled  bool
+	stopping   bool
+	lastActive time.Time
+	timers     map[string]*timer.Timer
+	handlers   map[interface{}]func(a *Actor, args []interface{})
+	// applied on the skeleton goroutine after the messages are processed
+	ops []func()
+}
+
+const minSweepInterval = time.Millisecond
+
+func (s *Skeleton) NewActorSystem(newEntity func(key interface{}) Entity) *ActorSystem {
+	sys := new(ActorSystem)
+	sys.skeleton = s
+	sys.newEntity = newEntity
+	sys.handlers = make(map[interface{}]func(a *Actor, args []interface{}))
+	sys.actors = make(map[interface{}]*Actor)
+	return sys
+}
+
+// you must call the function before calling Send
+func (sys *ActorSystem) Register(id interface{}, f func(a *Actor, args []interface{})) {
+	if _, ok := sys.handlers[id]; ok {
+		panic(fmt.Sprintf("function id %v: already registered", id))
+	}
+
+	sys.handlers[id] = f
+}
+
+func (sys *ActorSystem) Send(key interface{}, id interface{}, args ...interface{}) {
+	a := sys.actors[key]
+	if a == nil {
+		a = sys.create(key)
+	}
+
+	a.mailbox = append(a.mailbox, message{id, args})
+	sys.schedule(a)
+}
+
+// the number of actors
+func (sys *ActorSystem) Len() int {
+	return len(sys.actors)
+}
+
+// the actor stops once its queued messages are processed
+func (sys *ActorSystem) Stop(key interface{}) {
+	a := sys.actors[key]
+	if a == nil {
+		return
+	}
+
+	a.stopping = true
+	if !a.scheduled {
+		sys.destroy(a)
+	}
+}
+
+// Close destroys every actor, call it after Skeleton.Run returns,
+// e.g. in OnDestroy
+func (sys *ActorSystem) Close() {
+	for _, a := range sys.actors {
+		sys.destroy(a)
+	}
+	if sys.sweep != nil {
+		sys.sweep.Stop()
+		sys.sweep = nil
+	}
+}
+
+func (sys *ActorSystem) create(key interface{}) *Actor {
+	a := new(Actor)
+	a.key = key
+	a.system = sys
+	a.lastActive = sys.skeleton.Clock.Now()
+	a.entity = sys.newEntity(key)
+	sys.actors[key] = a
+
+	a.guard(func() {
+		a.entity.OnCreate(a)
+	})
+	a.flush()
+
+	if sys.IdleTimeout > 0 && sys.sweep == nil {
+		sys.sweep = sys.skeleton.AfterFunc(sys.IdleTimeout, sys.passivate)
+	}
+	return a
+}
+
+func (sys *ActorSystem) destroy(a *Actor) {
+	if sys.actors[a.key] != a {
+		return
+	}
+	delete(sys.actors, a.key)
+
+	for _, t := range a.timers {
+		t.Stop()
+	}
+	a.guard(func() {
+		a.entity.OnDestroy(a)
+	})
+	a.ops = nil
+	if len(a.mailbox) > 0 {
+		log.Debug("actor %v: %v messages dropped", a.key, len(a.mailbox))
+		a.mailbox = nil
+	}
+}
+
+func (sys *ActorSystem) schedule(a *Actor) {
+	if a.scheduled {
+		return
+	}
+	a.scheduled = true
+	sys.ready = append(sys.ready, a)
+	sys.dispatch()
+}
+
+func (sys *ActorSystem) dispatch() {
+	if sys.dispatching {
+		return
+	}
+	sys.dispatching = true
+	defer func() {
+		sys.dispatching = false
+	}()
+
+	for len(sys.ready) > 0 && (sys.Workers == 0 || sys.running < sys.Workers) {
+		a := sys.ready[0]
+		sys.ready[0] = nil
+		sys.ready = sys.ready[1:]
+
+		batch := a.mailbox
+		a.mailbox = nil
+		if sys.Workers == 0 {
+			a.process(batch)
+			sys.done(a)
+			continue
+		}
+
+		sys.running++
+		sys.skeleton.Go(func() {
+			a.process(batch)
+		}, func() {
+			sys.running--
+			sys.done(a)
+			sys.dispatch()
+		})
+	}
+}
+
+func (sys *ActorSystem) done(a *Actor) {
+	a.scheduled = false
+	a.lastActive = sys.skeleton.Clock.Now()
+	a.flush()
+
+	if a.stopping {
+		sys.destroy(a)
+	} else if len(a.mailbox) > 0 {
+		sys.schedule(a)
+	}
+}
+
+// the idle actors are passivated
+func (sys *ActorSystem) passivate() {
+	now := sys.skeleton.Clock.Now()
+	for _, a := range sys.actors {
+		if !a.scheduled && len(a.mailbox) == 0 && now.Sub(a.lastActive) >= sys.IdleTimeout {
+			sys.destroy(a)
+		}
+	}
+
+	sys.sweep = nil
+	if len(sys.actors) > 0 {
+		d := sys.IdleTimeout / 2
+		if d < minSweepInterval {
+			d = minSweepInterval
+		}
+		sys.sweep = sys.skeleton.AfterFunc(d, sys.passivate)
+	}
+}
+
+func (a *Actor) process(batch []message) {
+	for _, m := range batch {
+		f := a.handlers[m.id]
+		if f == nil {
+			f = a.system.handlers[m.id]
+		}
+		if f == nil {
+			log.Error("actor %v: function id %v: function not registered", a.key, m.id)
+			continue
+		}
+		a.guard(func() {
+			f(a, m.args)
+		})
+	}
+}
+
+func (a *Actor) flush() {
+	ops := a.ops
+	a.ops = nil
+	for _, op := range ops {
+		op()
+	}
+}
+
+func (a *Actor) guard(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			if conf.LenStackBuf > 0 {
+				buf := make([]byte, conf.LenStackBuf)
+				l := runtime.Stack(buf, false)
+				log.Error("actor %v: %v: %s", a.key, r, buf[:l])
+			} else {
+				log.Error("actor %v: %v", a.key, r)
+			}
+		}
+	}()
+
+	f()
+}
+
+func (a *Actor) Key() interface{} {
+	return a.key
+}
+
+func (a *Actor) Entity() Entity {
+	return a.entity
+}
+
+// the handler of the actor overrides the one of the ActorSystem
+func (a *Actor) Register(id interface{}, f func(a *Actor, args []interface{})) {
+	if _, ok := a.handlers[id]; ok {
+		panic(fmt.Sprintf("actor %v: function id %v: already registered", a.key, id))
+	}
+	if a.handlers == nil {
+		a.handlers = make(map[interface{}]func(a *Actor, args []interface{}))
+	}
+
+	a.handlers[id] = f
+}
+
+// the message is sent after the current messages are processed
+func (a *Actor) Send(key interface{}, id interface{}, args ...interface{}) {
+	a.ops = append(a.ops, func() {
+		a.system.Send(key, id, args...)
+	})
+}
+
+// the actor sends the message to itself after d,
+// a timer with the same name is replaced
+func (a *Actor) SetTimer(name string, d time.Duration, id interface{}, args ...interface{}) {
+	a.ops = append(a.ops, func() {
+		if a.system.actors[a.key] != a {
+			return
+		}
+		if t, ok := a.timers[name]; ok {
+			t.Stop()
+		}
+		if a.timers == nil {
+			a.timers = make(map[string]*timer.Timer)
+		}
+		a.timers[name] = a.system.skeleton.AfterFunc(d, func() {
+			delete(a.timers, name)
+			if a.system.actors[a.key] != a {
+				return
+			}
+			a.mailbox = append(a.mailbox, message{id, args})
+			a.system.schedule(a)
+		})
+	})
+}
+
+func (a *Actor) CancelTimer(name string) {
+	a.ops = append(a.ops, func() {
+		if t, ok := a.timers[name]; ok {
+			t.Stop()
+			delete(a.timers, name)
+		}
+	})
+}
+
+// the actor stops after the current messages are processed
+func (a *Actor) Stop() {
+	a.ops = append(a.ops, func() {
+		a.stopping = true
+	})
+}
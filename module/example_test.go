@@ -0,0 +1,324 @@
+package module_test
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shinjuwu/leaf/chanrpc"
+	"github.com/shinjuwu/leaf/module"
+)
+
+func ExampleHarness() {
+	s := &module.Skeleton{
+		GoLen:              10,
+		TimerDispatcherLen: 10,
+		AsynCallLen:        10,
+		AsynCallTimeout:    time.Second,
+		ChanRPCServer:      chanrpc.NewServer(10),
+	}
+	h := module.NewHarness(s, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	s.Init()
+
+	s.RegisterChanRPC("login", func(args []interface{}) interface{} {
+		s.AfterFunc(time.Minute, func() {
+			fmt.Println(args[0], "expired at", h.Clock.Now().Format("15:04:05"))
+		})
+		return "welcome " + args[0].(string)
+	})
+
+	// a server nobody serves
+	db := chanrpc.NewServer(10)
+	db.Register("load", func(args []interface{}) {})
+
+	fmt.Println(h.Call("login", "alice"))
+
+	s.Go(func() {}, func() {
+		fmt.Println("go callback")
+	})
+	fmt.Println(h.Pump())
+
+	s.AsynCall(db, "load", func(err error) {
+		fmt.Println(err, "at", h.Clock.Now().Format("15:04:05"))
+	})
+	h.Advance(30 * time.Second)
+	h.Advance(time.Minute)
+	fmt.Println(h.Clock.Now().Format("15:04:05"))
+
+	h.Close()
+
+	// Output:
+	// welcome alice <nil>
+	// go callback
+	// 1
+	// chanrpc call timeout at 00:00:01
+	// alice expired at 00:01:00
+	// 00:01:30
+}
+
+func ExampleNewHarness() {
+	defer func() {
+		fmt.Println(recover())
+	}()
+
+	// the timeouts of asynchronous calls would block the harness
+	module.NewHarness(&module.Skeleton{AsynCallLen: 10}, time.Now())
+
+	// Output:
+	// invalid TimerDispatcherLen
+}
+
+func ExampleSkeleton_TimerStat() {
+	s, h := newHarness()
+
+	t := s.AfterFunc(time.Second, func() {
+		fmt.Println("fired", h.Clock.Now().Format("15:04:05"))
+	})
+	// the shot is queued but not run before the timer is reset
+	h.Clock.Advance(time.Minute)
+	t.Reset(time.Second)
+	h.Advance(time.Second)
+
+	ts := s.TimerStat()
+	fmt.Println(ts.Count, ts.Max)
+
+	h.Close()
+
+	// Output:
+	// fired 00:01:01
+	// 1 0s
+}
+
+type account struct {
+	id      interface{}
+	balance int
+	history []int
+}
+
+func (acc *account) OnCreate(a *module.Actor) {
+	fmt.Println("create", a.Key())
+}
+
+func (acc *account) OnDestroy(a *module.Actor) {
+	fmt.Println("destroy", a.Key(), acc.balance)
+}
+
+func newHarness() (*module.Skeleton, *module.Harness) {
+	s := &module.Skeleton{
+		GoLen:              10,
+		TimerDispatcherLen: 10,
+	}
+	h := module.NewHarness(s, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	s.Init()
+	return s, h
+}
+
+func ExampleActorSystem() {
+	s, h := newHarness()
+
+	sys := s.NewActorSystem(func(key interface{}) module.Entity {
+		return &account{id: key}
+	})
+	sys.Register("deposit", func(a *module.Actor, args []interface{}) {
+		acc := a.Entity().(*account)
+		acc.balance += args[0].(int)
+		fmt.Println(a.Key(), acc.balance)
+	})
+	sys.Register("close", func(a *module.Actor, args []interface{}) {
+		a.Stop()
+	})
+	sys.Register("interest", func(a *module.Actor, args []interface{}) {
+		a.Send(a.Key(), "deposit", a.Entity().(*account).balance/10)
+	})
+	sys.Register("schedule", func(a *module.Actor, args []interface{}) {
+		a.SetTimer("interest", time.Hour, "interest")
+	})
+
+	sys.Send("alice", "deposit", 100)
+	sys.Send("bob", "deposit", 10)
+	sys.Send("alice", "deposit", 50)
+	sys.Send("alice", "schedule")
+	h.Advance(time.Hour)
+	sys.Send("bob", "close")
+	h.Pump()
+	fmt.Println(sys.Len())
+
+	sys.Close()
+	h.Close()
+
+	// Output:
+	// create alice
+	// alice 100
+	// create bob
+	// bob 10
+	// alice 150
+	// alice 165
+	// destroy bob 10
+	// 1
+	// destroy alice 165
+}
+
+func ExampleActorSystem_passivation() {
+	s, h := newHarness()
+
+	sys := s.NewActorSystem(func(key interface{}) module.Entity {
+		return &account{id: key}
+	})
+	sys.IdleTimeout = 10 * time.Second
+	sys.Register("deposit", func(a *module.Actor, args []interface{}) {
+		a.Entity().(*account).balance += args[0].(int)
+	})
+
+	sys.Send("alice", "deposit", 1)
+	sys.Send("bob", "deposit", 2)
+	h.Advance(5 * time.Second)
+	sys.Send("alice", "deposit", 3)
+
+	// bob is idle for 10s at 00:00:10, alice at 00:00:15
+	for i := 0; i < 4; i++ {
+		h.Advance(5 * time.Second)
+		fmt.Println(h.Clock.Now().Format("15:04:05"), sys.Len())
+	}
+
+	// a new actor for the key
+	sys.Send("bob", "deposit", 4)
+	h.Pump()
+	sys.Close()
+	h.Close()
+
+	// Output:
+	// create alice
+	// create bob
+	// destroy bob 2
+	// 00:00:10 1
+	// destroy alice 4
+	// 00:00:15 0
+	// 00:00:20 0
+	// 00:00:25 0
+	// create bob
+	// destroy bob 4
+}
+
+func ExampleActorSystem_workers() {
+	s, h := newHarness()
+
+	var running, maxRunning int32
+	sys := s.NewActorSystem(func(key interface{}) module.Entity {
+		return &account{id: key}
+	})
+	sys.Workers = 2
+	sys.Register("deposit", func(a *module.Actor, args []interface{}) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		acc := a.Entity().(*account)
+		acc.history = append(acc.history, args[0].(int))
+		atomic.AddInt32(&running, -1)
+	})
+
+	var mutex sync.Mutex
+	accounts := make(map[interface{}]*account)
+	sys.Register("get", func(a *module.Actor, args []interface{}) {
+		mutex.Lock()
+		accounts[a.Key()] = a.Entity().(*account)
+		mutex.Unlock()
+	})
+
+	for _, key := range []string{"alice", "bob", "carol"} {
+		sys.Send(key, "deposit", 0)
+	}
+	for i := 1; i < 5; i++ {
+		for _, key := range []string{"alice", "bob", "carol"} {
+			sys.Send(key, "deposit", i)
+		}
+	}
+	for _, key := range []string{"alice", "bob", "carol"} {
+		sys.Send(key, "get")
+	}
+	h.Pump()
+
+	for _, key := range []string{"alice", "bob", "carol"} {
+		fmt.Println(key, accounts[key].history)
+	}
+	fmt.Println(atomic.LoadInt32(&maxRunning) <= 2)
+
+	sys.Close()
+	h.Close()
+
+	// Unordered output:
+	// create alice
+	// create bob
+	// create carol
+	// alice [0 1 2 3 4]
+	// bob [0 1 2 3 4]
+	// carol [0 1 2 3 4]
+	// true
+	// destroy alice 0
+	// destroy bob 0
+	// destroy carol 0
+}
+
+type player struct {
+	table interface{}
+}
+
+func (p *player) OnCreate(a *module.Actor) {
+	a.Register("join", func(a *module.Actor, args []interface{}) {
+		p.table = args[0]
+		a.Send(p.table, "join", a.Key())
+	})
+}
+
+func (p *player) OnDestroy(a *module.Actor) {}
+
+type table struct {
+	players []interface{}
+}
+
+func (t *table) OnCreate(a *module.Actor) {
+	a.Register("join", func(a *module.Actor, args []interface{}) {
+		t.players = append(t.players, args[0])
+		fmt.Println(a.Key(), t.players)
+	})
+}
+
+func (t *table) OnDestroy(a *module.Actor) {}
+
+func ExampleActor_Register() {
+	s, h := newHarness()
+
+	// the players and the tables handle "join" differently
+	sys := s.NewActorSystem(func(key interface{}) module.Entity {
+		if _, ok := key.(int); ok {
+			return new(table)
+		}
+		return new(player)
+	})
+	sys.Register("leave", func(a *module.Actor, args []interface{}) {
+		fmt.Println(a.Key(), "leave")
+		a.Stop()
+	})
+
+	sys.Send("alice", "join", 1)
+	sys.Send("bob", "join", 1)
+	sys.Send("carol", "join", 2)
+	sys.Send("bob", "leave")
+	h.Pump()
+	fmt.Println(sys.Len())
+
+	sys.Close()
+	h.Close()
+
+	// Output:
+	// 1 [alice]
+	// 1 [alice bob]
+	// 2 [carol]
+	// bob leave
+	// 4
+}
@@ -0,0 +1,89 @@
+package module
+
+import (
+	"time"
+
+	"github.com/shinjuwu/leaf/timer"
+)
+
+// a Harness drives a Skeleton on the calling goroutine instead of
+// Skeleton.Run, the timers of the skeleton follow a virtual clock.
+// it is meant for tests, the results of the handlers can be checked
+// between the steps without synchronization
+type Harness struct {
+	Skeleton *Skeleton
+	Clock    *timer.VirtualClock
+}
+
+// the timers are dispatched on the calling goroutine, so the timeouts of
+// asynchronous calls need a TimerDispatcherLen.
+// you must call the function before calling Skeleton.Init
+func NewHarness(s *Skeleton, now time.Time) *Harness {
+	if s.AsynCallLen > 0 && s.TimerDispatcherLen <= 0 {
+		panic("invalid TimerDispatcherLen")
+	}
+
+	h := new(Harness)
+	h.Skeleton = s
+	h.Clock = timer.NewVirtualClock(now)
+	s.Clock = h.Clock
+	return h
+}
+
+// Pump executes the queued items until the skeleton is idle,
+// it waits for the functions started by Skeleton.Go.
+// returns the number of items executed
+func (h *Harness) Pump() int {
+	s := h.Skeleton
+	n := 0
+	for {
+		if s.poll() {
+			n++
+			continue
+		}
+		if s.g.Idle() {
+			return n
+		}
+		s.goCb(<-s.g.ChanCb)
+		n++
+	}
+}
+
+// Advance moves the virtual clock forward by d,
+// the queues are pumped after every expired timer
+func (h *Harness) Advance(d time.Duration) {
+	h.Pump()
+
+	end := h.Clock.Now().Add(d)
+	for {
+		next, ok := h.Clock.Next()
+		if !ok || next.After(end) {
+			break
+		}
+		h.Clock.Step()
+		h.Pump()
+	}
+	h.Clock.Set(end)
+}
+
+// Call executes the function id registered on the ChanRPCServer of the
+// skeleton and pumps the queues after it
+func (h *Harness) Call(id interface{}, args ...interface{}) (interface{}, error) {
+	ret, err := h.Skeleton.server.Invoke(id, args...)
+	h.Pump()
+	return ret, err
+}
+
+// Close closes the skeleton like Skeleton.Run does on closeSig,
+// the virtual clock is stepped for the pending asynchronous calls
+func (h *Harness) Close() {
+	s := h.Skeleton
+	s.commandServer.Close()
+	s.server.Close()
+	for !s.g.Idle() || !s.client.Idle() {
+		if h.Pump() == 0 && !h.Clock.Step() {
+			s.g.Close()
+			s.closeClient()
+		}
+	}
+}
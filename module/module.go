@@ -1,10 +1,16 @@
 package module
 
 import (
+	"context"
+	"fmt"
 	"github.com/shinjuwu/leaf/conf"
+	"github.com/shinjuwu/leaf/console"
 	"github.com/shinjuwu/leaf/log"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Module interface {
@@ -13,51 +19,244 @@ type Module interface {
 	Run(closeSig chan bool)
 }
 
+// optional, a named module can be depended on by other modules.
+// the modules are sorted before OnInit, so a module which assigns its
+// Skeleton in OnInit must be registered by RegisterNamed instead
+type Named interface {
+	GetName() string
+}
+
+// optional, the named modules returned by Dependencies are initialized
+// before the module and destroyed after it
+type Dependent interface {
+	Dependencies() []string
+}
+
+// optional, OnStart is called after the OnInit of every module,
+// before the modules run
+type Starter interface {
+	OnStart()
+}
+
+// optional, OnStop is called at the stop stage of shutdown,
+// the module stops accepting new connections or requests
+type Stopper interface {
+	OnStop()
+}
+
+// optional, OnNotify is called at the notify stage of shutdown,
+// the module notifies its clients that the server is going down
+type Notifier interface {
+	OnNotify()
+}
+
+// optional, Drain is called at the drain stage of shutdown,
+// it returns once the queued work of the module is done or ctx is done
+type Drainer interface {
+	Drain(ctx context.Context) error
+}
+
 type module struct {
 	mi       Module
+	name     string
 	closeSig chan bool
+	closing  int32
 	wg       sync.WaitGroup
+
+	// supervisor
+	mutex     sync.Mutex
+	state     string
+	restarts  []time.Time
+	lastCrash string
 }
 
-var mods []*module
+// Skeleton registers its console commands once the manager attaches
+// its console, and removes them before a restart
+type consoleAttacher interface {
+	attachConsole(c *console.Console)
+	detachConsole()
+}
+
+// the state closed by a crashed Run is rebuilt before OnInit
+type reopener interface {
+	reopen()
+}
+
+// a Manager owns a list of modules, the package level functions
+// use the default manager
+type Manager struct {
+	// the policy of the modules which do not implement Supervised
+	RestartPolicy RestartPolicy
+	console       *console.Console
+	mods          []*module
+	commandOnce   sync.Once
+}
+
+var std = NewManager(console.Default())
+
+func Default() *Manager {
+	return std
+}
+
+func NewManager(c *console.Console) *Manager {
+	m := new(Manager)
+	m.console = c
+	return m
+}
 
 func Register(mi Module) {
+	std.Register(mi)
+}
+
+func RegisterNamed(name string, mi Module) {
+	std.RegisterNamed(name, mi)
+}
+
+func Init() {
+	if err := std.Init(); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+func Stop() error {
+	return std.Stop(context.Background())
+}
+
+func Notify() error {
+	return std.Notify(context.Background())
+}
+
+func Drain() error {
+	return std.Drain(context.Background())
+}
+
+func Destroy() error {
+	return std.Destroy(context.Background())
+}
+
+func (mgr *Manager) Register(mi Module) {
+	mgr.RegisterNamed("", mi)
+}
+
+// the module can be depended on by name, whether it implements Named or not
+func (mgr *Manager) RegisterNamed(name string, mi Module) {
 	m := new(module)
 	m.mi = mi
+	m.name = name
 	m.closeSig = make(chan bool, 1)
 
-	mods = append(mods, m)
+	mgr.mods = append(mgr.mods, m)
 }
 
-func Init() {
-	for i := 0; i < len(mods); i++ {
-		mods[i].mi.OnInit()
+func (mgr *Manager) Init() error {
+	sorted, err := sortModules(mgr.mods)
+	if err != nil {
+		return err
+	}
+	mgr.mods = sorted
+
+	for i := 0; i < len(mgr.mods); i++ {
+		mgr.mods[i].mi.OnInit()
+		if a, ok := mgr.mods[i].mi.(consoleAttacher); ok {
+			a.attachConsole(mgr.console)
+		}
+	}
+
+	for i := 0; i < len(mgr.mods); i++ {
+		if s, ok := mgr.mods[i].mi.(Starter); ok {
+			s.OnStart()
+		}
 	}
 
-	for i := 0; i < len(mods); i++ {
-		m := mods[i]
+	for i := 0; i < len(mgr.mods); i++ {
+		m := mgr.mods[i]
+		m.state = stateRunning
 		m.wg.Add(1)
-		go run(m)
+		go mgr.run(m)
 	}
+
+	mgr.commandOnce.Do(func() {
+		mgr.console.RegisterFunc("module", "module states and restarts, module [name] for details", mgr.commandModule)
+	})
+
+	return nil
 }
 
-func Destroy() {
-	for i := len(mods) - 1; i >= 0; i-- {
-		m := mods[i]
+// shutdown stages: Stop, Notify, Drain and Destroy.
+// every stage visits the modules in the reverse order of initialization
+// and returns an error naming the stuck module if the stage is not done
+// within its timeout (conf.StopTimeout etc.) or before ctx is done
+
+func (mgr *Manager) Stop(ctx context.Context) error {
+	return mgr.runStage(ctx, "stop", conf.StopTimeout, func(ctx context.Context, m *module) error {
+		if s, ok := m.mi.(Stopper); ok {
+			guard(s.OnStop)
+		}
+		return nil
+	})
+}
+
+func (mgr *Manager) Notify(ctx context.Context) error {
+	return mgr.runStage(ctx, "notify", conf.NotifyTimeout, func(ctx context.Context, m *module) error {
+		if n, ok := m.mi.(Notifier); ok {
+			guard(n.OnNotify)
+		}
+		return nil
+	})
+}
+
+func (mgr *Manager) Drain(ctx context.Context) error {
+	return mgr.runStage(ctx, "drain", conf.DrainTimeout, func(ctx context.Context, m *module) error {
+		if d, ok := m.mi.(Drainer); ok {
+			return d.Drain(ctx)
+		}
+		return nil
+	})
+}
+
+func (mgr *Manager) Destroy(ctx context.Context) error {
+	return mgr.runStage(ctx, "destroy", conf.DestroyTimeout, func(ctx context.Context, m *module) error {
+		atomic.StoreInt32(&m.closing, 1)
 		m.closeSig <- true
 		m.wg.Wait()
 		destroy(m)
-	}
+		m.setState(stateStopped)
+		return nil
+	})
 }
 
-func run(m *module) {
-	m.mi.Run(m.closeSig)
-	m.wg.Done()
+func (mgr *Manager) runStage(ctx context.Context, stage string, timeout time.Duration, f func(ctx context.Context, m *module) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	for i := len(mgr.mods) - 1; i >= 0; i-- {
+		m := mgr.mods[i]
+		done := make(chan error, 1)
+		go func() {
+			done <- f(ctx, m)
+		}()
+
+		var err error
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("module %v: %v stage: %v", m.getName(), stage, err)
+		}
+	}
+
+	return nil
 }
 
-func destroy(m *module) {
+func guard(f func()) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
 			if conf.LenStackBuf > 0 {
 				buf := make([]byte, conf.LenStackBuf)
 				l := runtime.Stack(buf, false)
@@ -68,5 +267,95 @@ func destroy(m *module) {
 		}
 	}()
 
-	m.mi.OnDestroy()
+	f()
+	return nil
+}
+
+func destroy(m *module) {
+	guard(m.mi.OnDestroy)
+}
+
+// the registered name, the name of Named or the type
+func (m *module) getName() string {
+	if n := m.registeredName(); n != "" {
+		return n
+	}
+	return fmt.Sprintf("%T", m.mi)
+}
+
+func (m *module) registeredName() string {
+	if m.name != "" {
+		return m.name
+	}
+	if n, ok := m.mi.(Named); ok {
+		return n.GetName()
+	}
+	return ""
+}
+
+// the modules are sorted topologically by their dependencies,
+// independent modules keep the registration order
+func sortModules(mods []*module) ([]*module, error) {
+	named := make(map[string]*module)
+	for _, m := range mods {
+		n := m.registeredName()
+		if n == "" {
+			continue
+		}
+		if _, ok := named[n]; ok {
+			return nil, fmt.Errorf("module %v: already registered", n)
+		}
+		named[n] = m
+	}
+
+	deps := make(map[*module][]*module)
+	for _, m := range mods {
+		d, ok := m.mi.(Dependent)
+		if !ok {
+			continue
+		}
+		for _, dn := range d.Dependencies() {
+			dm, ok := named[dn]
+			if !ok {
+				return nil, fmt.Errorf("module %v: dependency %v not registered", m.getName(), dn)
+			}
+			deps[m] = append(deps[m], dm)
+		}
+	}
+
+	sorted := make([]*module, 0, len(mods))
+	placed := make(map[*module]bool)
+	for len(sorted) < len(mods) {
+		progress := false
+		for _, m := range mods {
+			if placed[m] {
+				continue
+			}
+			ready := true
+			for _, dm := range deps[m] {
+				if !placed[dm] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				sorted = append(sorted, m)
+				placed[m] = true
+				progress = true
+				break
+			}
+		}
+
+		if !progress {
+			var cycle []string
+			for _, m := range mods {
+				if !placed[m] {
+					cycle = append(cycle, m.getName())
+				}
+			}
+			return nil, fmt.Errorf("module dependency cycle: %v", strings.Join(cycle, ", "))
+		}
+	}
+
+	return sorted, nil
 }
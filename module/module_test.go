@@ -0,0 +1,130 @@
+package module
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/shinjuwu/leaf/console"
+)
+
+type testModule struct {
+	name string
+	deps []string
+}
+
+func (m *testModule) OnInit()                {}
+func (m *testModule) OnDestroy()             {}
+func (m *testModule) Run(closeSig chan bool) { <-closeSig }
+func (m *testModule) GetName() string        { return m.name }
+func (m *testModule) Dependencies() []string { return m.deps }
+
+func testModules(mis ...*testModule) []*module {
+	var mods []*module
+	for _, mi := range mis {
+		mods = append(mods, &module{mi: mi})
+	}
+	return mods
+}
+
+func names(mods []*module) []string {
+	var ns []string
+	for _, m := range mods {
+		ns = append(ns, m.getName())
+	}
+	return ns
+}
+
+func TestSortModules(t *testing.T) {
+	tests := []struct {
+		mods []*module
+		want []string
+		err  string
+	}{
+		{
+			mods: testModules(&testModule{name: "a"}, &testModule{name: "b"}, &testModule{name: "c"}),
+			want: []string{"a", "b", "c"},
+		},
+		{
+			mods: testModules(
+				&testModule{name: "game", deps: []string{"db", "login"}},
+				&testModule{name: "login", deps: []string{"db"}},
+				&testModule{name: "gate"},
+				&testModule{name: "db"},
+			),
+			want: []string{"gate", "db", "login", "game"},
+		},
+		{
+			mods: testModules(&testModule{name: "a"}, &testModule{name: "a"}),
+			err:  "module a: already registered",
+		},
+		{
+			mods: testModules(&testModule{name: "a", deps: []string{"b"}}),
+			err:  "module a: dependency b not registered",
+		},
+		{
+			mods: testModules(
+				&testModule{name: "a", deps: []string{"c"}},
+				&testModule{name: "b"},
+				&testModule{name: "c", deps: []string{"a"}},
+			),
+			err: "module dependency cycle: a, c",
+		},
+	}
+
+	for i, test := range tests {
+		sorted, err := sortModules(test.mods)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%v: error %v, want %v", i, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+			continue
+		}
+		if got := names(sorted); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+// the usual leaf module, the skeleton is assigned in OnInit
+type skeletonModule struct {
+	*Skeleton
+	name string
+}
+
+func (m *skeletonModule) OnInit() {
+	m.Skeleton = &Skeleton{Name: m.name}
+	m.Skeleton.Init()
+}
+
+func (m *skeletonModule) OnDestroy() {}
+
+func TestSortSkeletonModules(t *testing.T) {
+	login := &testModule{name: "login", deps: []string{"game"}}
+
+	// the name of the skeleton is unknown before OnInit
+	mgr := NewManager(console.New())
+	mgr.Register(login)
+	mgr.Register(&skeletonModule{name: "game"})
+	err := mgr.Init()
+	if err == nil || err.Error() != "module login: dependency game not registered" {
+		t.Fatalf("error %v", err)
+	}
+
+	mgr = NewManager(console.New())
+	mgr.Register(login)
+	mgr.RegisterNamed("game", &skeletonModule{name: "game"})
+	if err := mgr.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(mgr.mods); !reflect.DeepEqual(got, []string{"game", "login"}) {
+		t.Errorf("%v, want [game login]", got)
+	}
+	if err := mgr.Destroy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
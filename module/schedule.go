@@ -0,0 +1,223 @@
+package module
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// the event sources of a Skeleton
+type Source int
+
+const (
+	SourceCall Source = iota
+	SourceCommand
+	SourceAsynRet
+	SourceGoCb
+	SourceTimer
+	numSource
+)
+
+func (src Source) String() string {
+	switch src {
+	case SourceCall:
+		return "call"
+	case SourceCommand:
+		return "command"
+	case SourceAsynRet:
+		return "asynret"
+	case SourceGoCb:
+		return "gocb"
+	case SourceTimer:
+		return "timer"
+	default:
+		return fmt.Sprintf("source(%d)", int(src))
+	}
+}
+
+// a SchedulePolicy visits the sources of a Skeleton round robin,
+// timers first, and executes at most Budget[src] queued items of a source
+// per round. a budget less than 1 is 1, priority calls are not budgeted
+type SchedulePolicy struct {
+	Budget [numSource]int
+}
+
+// a timer waits for at most one item of every other source,
+// raise the budgets of the sources which may be delayed for throughput
+func NewSchedulePolicy() *SchedulePolicy {
+	p := new(SchedulePolicy)
+	for src := range p.Budget {
+		p.Budget[src] = 1
+	}
+	p.Budget[SourceTimer] = 16
+	return p
+}
+
+var roundOrder = [numSource]Source{SourceTimer, SourceCall, SourceCommand, SourceAsynRet, SourceGoCb}
+
+// returns false if nothing is queued
+func (s *Skeleton) round() bool {
+	n := 0
+	for _, src := range roundOrder {
+		budget := s.Schedule.Budget[src]
+		if budget < 1 {
+			budget = 1
+		}
+		for i := 0; i < budget; i++ {
+			s.drainPriority()
+			if !s.pollSource(src) {
+				break
+			}
+			n++
+		}
+	}
+	return n > 0
+}
+
+func (s *Skeleton) drainPriority() {
+	for {
+		select {
+		case ci := <-s.server.ChanPriorityCall:
+			s.exec(s.server, ci)
+		default:
+			return
+		}
+	}
+}
+
+// executes one queued item of src without blocking
+func (s *Skeleton) pollSource(src Source) bool {
+	switch src {
+	case SourceCall:
+		select {
+		case ci := <-s.server.ChanCall:
+			s.exec(s.server, ci)
+			return true
+		default:
+		}
+	case SourceCommand:
+		select {
+		case ci := <-s.commandServer.ChanCall:
+			s.exec(s.commandServer, ci)
+			return true
+		default:
+		}
+	case SourceAsynRet:
+		select {
+		case ri := <-s.client.ChanAsynRet:
+			s.cb(ri)
+			return true
+		default:
+		}
+	case SourceGoCb:
+		select {
+		case cb := <-s.g.ChanCb:
+			s.goCb(cb)
+			return true
+		default:
+		}
+	case SourceTimer:
+		select {
+		case t := <-s.dispatcher.ChanTimer:
+			s.timer(t)
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// how late the timers fire relative to their deadlines
+type TimerStat struct {
+	Count int64
+	Total time.Duration
+	Max   time.Duration
+}
+
+func (ts *TimerStat) Avg() time.Duration {
+	if ts.Count == 0 {
+		return 0
+	}
+	return ts.Total / time.Duration(ts.Count)
+}
+
+// 64-bit fields first for atomic access
+type skeletonStat struct {
+	timerCount int64
+	timerTotal int64
+	timerMax   int64
+	items      [numSource]uint64
+}
+
+func (st *skeletonStat) executed(src Source) {
+	atomic.AddUint64(&st.items[src], 1)
+}
+
+func (st *skeletonStat) timerLate(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	atomic.AddInt64(&st.timerCount, 1)
+	atomic.AddInt64(&st.timerTotal, int64(d))
+	for {
+		max := atomic.LoadInt64(&st.timerMax)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&st.timerMax, max, int64(d)) {
+			break
+		}
+	}
+}
+
+// goroutine safe
+func (s *Skeleton) TimerStat() TimerStat {
+	return TimerStat{
+		Count: atomic.LoadInt64(&s.stat.timerCount),
+		Total: time.Duration(atomic.LoadInt64(&s.stat.timerTotal)),
+		Max:   time.Duration(atomic.LoadInt64(&s.stat.timerMax)),
+	}
+}
+
+// the number of items executed from src
+// goroutine safe
+func (s *Skeleton) Executed(src Source) uint64 {
+	return atomic.LoadUint64(&s.stat.items[src])
+}
+
+// the functions of Go which found the queue of the pool full,
+// and the ones dropped, see g.RejectPolicy
+type GoStat struct {
+	Rejected  int64
+	Discarded int64
+}
+
+// goroutine safe
+func (s *Skeleton) GoStat() GoStat {
+	return GoStat{
+		Rejected:  s.g.Rejected(),
+		Discarded: s.g.Discarded(),
+	}
+}
+
+// detail of the module console command
+func (s *Skeleton) describe() string {
+	if s == nil || s.stat == nil {
+		return ""
+	}
+
+	output := "executed:"
+	for src := SourceCall; src < numSource; src++ {
+		output += fmt.Sprintf(" %v %v", src, s.Executed(src))
+	}
+	ts := s.TimerStat()
+	output += fmt.Sprintf("\ntimer lateness: count %v, avg %v, max %v", ts.Count, ts.Avg(), ts.Max)
+	if s.GoWorkers > 0 {
+		gs := s.GoStat()
+		output += fmt.Sprintf("\ngo pool: rejected %v, discarded %v", gs.Rejected, gs.Discarded)
+	}
+	if s.Schedule != nil {
+		output += "\nschedule budget:"
+		for src := SourceCall; src < numSource; src++ {
+			output += fmt.Sprintf(" %v %v", src, s.Schedule.Budget[src])
+		}
+	}
+	return output
+}
@@ -1,24 +1,67 @@
 package module
 
 import (
+	"context"
 	"time"
 
 	"github.com/shinjuwu/leaf/chanrpc"
+	"github.com/shinjuwu/leaf/cluster"
 	"github.com/shinjuwu/leaf/console"
 	g "github.com/shinjuwu/leaf/go"
 	"github.com/shinjuwu/leaf/timer"
 )
 
+// SlowThreshold: an item (chanrpc call, timer, callback) running longer
+// is logged with the stack of the module goroutine.
+// SaturationInterval: the busy time of the module goroutine is reported
+// periodically.
+// Clock: the clock of the timers, timer.RealClock if nil.
+// TimerTick: the timers are kept in a timing wheel of the tick if Clock is nil,
+// for many timers of a coarse resolution.
+// Schedule: the queued items are executed by the budgets of the policy,
+// otherwise the sources are selected at random.
+// GoWorkers: the functions of Go run on a pool of GoWorkers goroutines,
+// at most GoQueueLen functions wait for a worker, GoReject applies beyond
 type Skeleton struct {
+	Name               string
 	GoLen              int
+	GoWorkers          int
+	GoQueueLen         int
+	GoReject           g.RejectPolicy
 	TimerDispatcherLen int
 	AsynCallLen        int
+	AsynCallTimeout    time.Duration
+	SlowThreshold      time.Duration
+	SaturationInterval time.Duration
+	Clock              timer.Clock
+	TimerTick          time.Duration
+	Schedule           *SchedulePolicy
 	ChanRPCServer      *chanrpc.Server
 	g                  *g.Go
 	dispatcher         *timer.Dispatcher
 	client             *chanrpc.Client
 	server             *chanrpc.Server
 	commandServer      *chanrpc.Server
+	console            *console.Console
+	commands           []command
+	watchdog           *watchdog
+	stat               *skeletonStat
+	wheel              bool
+	closed             bool
+}
+
+type command struct {
+	name string
+	help string
+	f    interface{}
+}
+
+// the name is empty while the skeleton is nil, see RegisterNamed
+func (s *Skeleton) GetName() string {
+	if s == nil {
+		return ""
+	}
+	return s.Name
 }
 
 func (s *Skeleton) Init() {
@@ -32,38 +75,213 @@ func (s *Skeleton) Init() {
 		s.AsynCallLen = 0
 	}
 
-	s.g = g.New(s.GoLen)
-	s.dispatcher = timer.NewDispatcher(s.TimerDispatcherLen)
+	s.newGo()
+	s.wheel = s.Clock == nil && s.TimerTick > 0
+	if s.Clock == nil && !s.wheel {
+		s.Clock = timer.RealClock
+	}
+	s.newDispatcher()
 	s.client = chanrpc.NewClient(s.AsynCallLen)
+	s.client.SetTimeout(s.dispatcher, s.AsynCallTimeout)
 	s.server = s.ChanRPCServer
 
 	if s.server == nil {
 		s.server = chanrpc.NewServer(0)
 	}
+	s.server.EnablePriority()
 	s.commandServer = chanrpc.NewServer(0)
+	s.stat = new(skeletonStat)
+}
+
+func (s *Skeleton) newGo() {
+	s.g = g.New(s.GoLen)
+	if s.GoWorkers > 0 {
+		s.g.SetPool(s.GoWorkers, s.GoQueueLen, s.GoReject)
+	}
+}
+
+func (s *Skeleton) newDispatcher() {
+	if s.wheel {
+		s.dispatcher = timer.NewWheelDispatcher(s.TimerDispatcherLen, s.TimerTick)
+		s.Clock = s.dispatcher.Clock()
+	} else {
+		s.dispatcher = timer.NewDispatcherWithClock(s.TimerDispatcherLen, s.Clock)
+	}
+}
+
+// a skeleton closed by a crashed Run is opened again when the module
+// is restarted, the timers and the contexts of Go are not restored
+func (s *Skeleton) reopen() {
+	if !s.closed {
+		return
+	}
+	s.closed = false
+
+	s.server.Reopen()
+	s.commandServer.Reopen()
+	s.newGo()
+	s.newDispatcher()
+	s.client.SetTimeout(s.dispatcher, s.AsynCallTimeout)
+}
+
+// the commands registered before are added to c
+func (s *Skeleton) attachConsole(c *console.Console) {
+	if s.console == c {
+		return
+	}
+	s.detachConsole()
+
+	s.console = c
+	if s.Name != "" {
+		c.RegisterChanRPC(s.Name, s.server, s.client)
+	}
+	for _, cmd := range s.commands {
+		c.Register(cmd.name, cmd.help, cmd.f, s.commandServer)
+	}
+}
+
+func (s *Skeleton) detachConsole() {
+	if s.console == nil {
+		return
+	}
+
+	if s.Name != "" {
+		s.console.UnregisterChanRPC(s.Name)
+	}
+	// the commands are kept for the next attach
+	for _, cmd := range s.commands {
+		s.console.Unregister(cmd.name)
+		s.commandServer.Unregister(cmd.name)
+	}
+	s.console = nil
 }
 
 func (s *Skeleton) Run(closeSig chan bool) {
+	if s.SlowThreshold > 0 || s.SaturationInterval > 0 {
+		s.watchdog = newWatchdog(s.Name, s.SlowThreshold, s.SaturationInterval)
+		defer s.watchdog.close()
+	}
+
 	for {
+		// priority calls are always drained first
 		select {
-		case <-closeSig:
-			s.commandServer.Close()
-			s.server.Close()
-			for !s.g.Idle() || !s.client.Idle() {
-				s.g.Close()
-				s.client.Close()
+		case ci := <-s.server.ChanPriorityCall:
+			s.exec(s.server, ci)
+			continue
+		default:
+		}
+
+		// a round of the schedule policy, the select below blocks
+		// only if nothing is queued
+		if s.Schedule != nil && s.round() {
+			select {
+			case <-closeSig:
+				s.close()
+				return
+			default:
 			}
+			continue
+		}
+
+		select {
+		case <-closeSig:
+			s.close()
 			return
 		case ri := <-s.client.ChanAsynRet:
-			s.client.Cb(ri)
+			s.cb(ri)
+		case ci := <-s.server.ChanPriorityCall:
+			s.exec(s.server, ci)
 		case ci := <-s.server.ChanCall:
-			s.server.Exec(ci)
+			s.exec(s.server, ci)
 		case ci := <-s.commandServer.ChanCall:
-			s.commandServer.Exec(ci)
+			s.exec(s.commandServer, ci)
 		case cb := <-s.g.ChanCb:
-			s.g.Cb(cb)
+			s.goCb(cb)
 		case t := <-s.dispatcher.ChanTimer:
-			t.Cb()
+			s.timer(t)
+		}
+	}
+}
+
+// executes one queued item without blocking, in a fixed order:
+// priority calls, calls, commands, asynchronous returns, callbacks and timers.
+// returns false if nothing is queued
+func (s *Skeleton) poll() bool {
+	select {
+	case ci := <-s.server.ChanPriorityCall:
+		s.exec(s.server, ci)
+		return true
+	default:
+	}
+	for src := SourceCall; src < numSource; src++ {
+		if s.pollSource(src) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Skeleton) close() {
+	s.commandServer.Close()
+	s.server.Close()
+	for !s.g.Idle() || !s.client.Idle() {
+		s.g.Close()
+		s.closeClient()
+	}
+	s.dispatcher.Close()
+	s.closed = true
+}
+
+func (s *Skeleton) exec(server *chanrpc.Server, ci *chanrpc.CallInfo) {
+	s.watchdog.begin("chanrpc call", ci.ID())
+	server.Exec(ci)
+	s.watchdog.end()
+	if server == s.commandServer {
+		s.stat.executed(SourceCommand)
+	} else {
+		s.stat.executed(SourceCall)
+	}
+}
+
+func (s *Skeleton) cb(ri *chanrpc.RetInfo) {
+	s.watchdog.begin("asynchronous return", nil)
+	s.client.Cb(ri)
+	s.watchdog.end()
+	s.stat.executed(SourceAsynRet)
+}
+
+func (s *Skeleton) goCb(cb func()) {
+	s.watchdog.begin("go callback", nil)
+	s.g.Cb(cb)
+	s.watchdog.end()
+	s.stat.executed(SourceGoCb)
+}
+
+func (s *Skeleton) timer(t *timer.Timer) {
+	// the stale shots do not run
+	if !t.Stale() {
+		s.stat.timerLate(s.Clock.Now().Sub(t.Deadline()))
+	}
+	s.watchdog.begin("timer", nil)
+	t.Cb()
+	s.watchdog.end()
+	s.stat.executed(SourceTimer)
+}
+
+// returns once the calls queued before it are executed
+func (s *Skeleton) Drain(ctx context.Context) error {
+	return s.server.Flush(ctx)
+}
+
+// timers are still dispatched while closing the client,
+// so that pending asynchronous calls can time out
+func (s *Skeleton) closeClient() {
+	for !s.client.Idle() {
+		select {
+		case ri := <-s.client.ChanAsynRet:
+			s.cb(ri)
+		case t := <-s.dispatcher.ChanTimer:
+			s.timer(t)
 		}
 	}
 }
@@ -84,6 +302,33 @@ func (s *Skeleton) CronFunc(cronExpr *timer.CronExpr, cb func()) *timer.Cron {
 	return s.dispatcher.CronFunc(cronExpr, cb)
 }
 
+// the job runs on one live node of c only, see cluster.Cluster.CronFunc
+func (s *Skeleton) ClusterCronFunc(c *cluster.Cluster, name string, cronExpr *timer.CronExpr, cb func()) *timer.Cron {
+	if s.TimerDispatcherLen == 0 {
+		panic("invalid TimerDispatcherLen")
+	}
+
+	return c.CronFunc(s.dispatcher, name, cronExpr, cb)
+}
+
+func (s *Skeleton) TickerFunc(d time.Duration, policy timer.TickPolicy, cb func()) *timer.Ticker {
+	if s.TimerDispatcherLen == 0 {
+		panic("invalid TimerDispatcherLen")
+	}
+
+	return s.dispatcher.TickerFunc(d, policy, cb)
+}
+
+// the jobs run on the skeleton goroutine, call Scheduler.Start in OnInit
+// after registering the jobs
+func (s *Skeleton) NewScheduler(store timer.JobStore) *timer.Scheduler {
+	if s.TimerDispatcherLen == 0 {
+		panic("invalid TimerDispatcherLen")
+	}
+
+	return timer.NewScheduler(s.dispatcher, store)
+}
+
 func (s *Skeleton) Go(f func(), cb func()) {
 	if s.GoLen == 0 {
 		panic("invalid GoLen")
@@ -92,6 +337,40 @@ func (s *Skeleton) Go(f func(), cb func()) {
 	s.g.Go(f, cb)
 }
 
+func (s *Skeleton) GoResult(f func() (interface{}, error), cb func(ret interface{}, err error)) {
+	if s.GoLen == 0 {
+		panic("invalid GoLen")
+	}
+
+	s.g.GoResult(f, cb)
+}
+
+// ctx is cancelled when the skeleton closes
+func (s *Skeleton) GoCtx(f func(ctx context.Context), cb func()) {
+	if s.GoLen == 0 {
+		panic("invalid GoLen")
+	}
+
+	s.g.GoCtx(f, cb)
+}
+
+// the functions of the same key run in order, on runtime.NumCPU() goroutines
+func (s *Skeleton) GoKeyed(key interface{}, f func(), cb func()) {
+	if s.GoLen == 0 {
+		panic("invalid GoLen")
+	}
+
+	s.g.GoKeyed(key, f, cb)
+}
+
+func (s *Skeleton) NewKeyedContext(n int) *g.KeyedContext {
+	if s.GoLen == 0 {
+		panic("invalid GoLen")
+	}
+
+	return s.g.NewKeyedContext(n)
+}
+
 func (s *Skeleton) NewLinearContext() *g.LinearContext {
 	if s.GoLen == 0 {
 		panic("invalid GoLen")
@@ -109,6 +388,24 @@ func (s *Skeleton) AsynCall(server *chanrpc.Server, id interface{}, args ...inte
 	s.client.AsynCall(id, args...)
 }
 
+func (s *Skeleton) AsynCallWithTimeout(d time.Duration, server *chanrpc.Server, id interface{}, args ...interface{}) {
+	if s.AsynCallLen == 0 {
+		panic("invalid AsynCallLen")
+	}
+
+	s.client.Attach(server)
+	s.client.AsynCallWithTimeout(d, id, args...)
+}
+
+func (s *Skeleton) AsynCallFuture(server *chanrpc.Server, id interface{}, args ...interface{}) *chanrpc.Future {
+	if s.AsynCallLen == 0 {
+		panic("invalid AsynCallLen")
+	}
+
+	s.client.Attach(server)
+	return s.client.AsynCallFuture(id, args...)
+}
+
 func (s *Skeleton) RegisterChanRPC(id interface{}, f interface{}) {
 	if s.ChanRPCServer == nil {
 		panic("invalid ChanRPCServer")
@@ -117,6 +414,34 @@ func (s *Skeleton) RegisterChanRPC(id interface{}, f interface{}) {
 	s.server.Register(id, f)
 }
 
+func (s *Skeleton) RegisterChanRPCTyped(id interface{}, f interface{}) {
+	if s.ChanRPCServer == nil {
+		panic("invalid ChanRPCServer")
+	}
+
+	s.server.RegisterTyped(id, f)
+}
+
+func (s *Skeleton) AddInterceptor(i chanrpc.Interceptor) {
+	if s.ChanRPCServer == nil {
+		panic("invalid ChanRPCServer")
+	}
+
+	s.server.AddInterceptor(i)
+}
+
+// a command registered again while detached replaces the former one,
+// so that OnInit may register its commands again on a restart
 func (s *Skeleton) RegisterCommand(name string, help string, f interface{}) {
-	console.Register(name, help, f, s.commandServer)
+	for i := range s.commands {
+		if s.commands[i].name == name && s.console == nil {
+			s.commands[i] = command{name, help, f}
+			return
+		}
+	}
+
+	s.commands = append(s.commands, command{name, help, f})
+	if s.console != nil {
+		s.console.Register(name, help, f, s.commandServer)
+	}
 }
@@ -0,0 +1,196 @@
+package module
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shinjuwu/leaf/log"
+)
+
+type RestartMode int
+
+const (
+	RestartNever RestartMode = iota
+	RestartAlways
+	RestartLimited
+)
+
+// a module crashes if its Run panics or returns before closeSig.
+// RestartLimited restarts the module at most Max times within Window,
+// a zero Window means the whole lifetime of the module.
+// Delay is waited before every restart.
+// a panic that is not restarted is fatal, as in an unsupervised module
+type RestartPolicy struct {
+	Mode   RestartMode
+	Max    int
+	Window time.Duration
+	Delay  time.Duration
+}
+
+// optional, the policy of the module overrides Manager.RestartPolicy
+type Supervised interface {
+	RestartPolicy() RestartPolicy
+}
+
+const (
+	stateRunning    = "running"
+	stateRestarting = "restarting"
+	stateCrashed    = "crashed"
+	stateStopped    = "stopped"
+)
+
+func (p *RestartPolicy) allow(restarts []time.Time, now time.Time) bool {
+	switch p.Mode {
+	case RestartAlways:
+		return true
+	case RestartLimited:
+		n := 0
+		for _, t := range restarts {
+			if p.Window == 0 || now.Sub(t) < p.Window {
+				n++
+			}
+		}
+		return n < p.Max
+	default:
+		return false
+	}
+}
+
+func (mgr *Manager) run(m *module) {
+	defer m.wg.Done()
+
+	for {
+		err := guard(func() {
+			m.mi.Run(m.closeSig)
+		})
+		if atomic.LoadInt32(&m.closing) == 1 {
+			return
+		}
+		panicked := err != nil
+		if !panicked {
+			err = errors.New("run returned before close")
+		}
+		if !mgr.restart(m, err, panicked) {
+			return
+		}
+	}
+}
+
+// OnDestroy and OnInit of the module are called again,
+// a panic in OnInit counts as another crash
+func (mgr *Manager) restart(m *module, reason error, panicked bool) bool {
+	p := mgr.RestartPolicy
+	if s, ok := m.mi.(Supervised); ok {
+		p = s.RestartPolicy()
+	}
+
+	for {
+		log.Error("module %v crashed: %v", m.getName(), reason)
+
+		m.mutex.Lock()
+		m.lastCrash = reason.Error()
+		ok := p.allow(m.restarts, time.Now())
+		if ok {
+			m.state = stateRestarting
+			m.restarts = append(m.restarts, time.Now())
+		} else {
+			m.state = stateCrashed
+		}
+		m.mutex.Unlock()
+
+		if !ok {
+			if panicked {
+				log.Fatal("module %v is not restarted", m.getName())
+			}
+			log.Error("module %v is not restarted", m.getName())
+			return false
+		}
+
+		if p.Delay > 0 {
+			time.Sleep(p.Delay)
+		}
+		if atomic.LoadInt32(&m.closing) == 1 {
+			return false
+		}
+
+		// the following crashes are panics
+		panicked = true
+		guard(m.mi.OnDestroy)
+		a, attacher := m.mi.(consoleAttacher)
+		if attacher {
+			a.detachConsole()
+		}
+		if r, ok := m.mi.(reopener); ok {
+			r.reopen()
+		}
+		reason = guard(m.mi.OnInit)
+		if reason != nil {
+			continue
+		}
+		if attacher {
+			reason = guard(func() {
+				a.attachConsole(mgr.console)
+			})
+			if reason != nil {
+				continue
+			}
+		}
+		if s, ok := m.mi.(Starter); ok {
+			reason = guard(s.OnStart)
+			if reason != nil {
+				continue
+			}
+		}
+
+		m.mutex.Lock()
+		m.state = stateRunning
+		n := len(m.restarts)
+		m.mutex.Unlock()
+
+		log.Release("module %v restarted (%v restarts)", m.getName(), n)
+		return true
+	}
+}
+
+func (m *module) setState(state string) {
+	m.mutex.Lock()
+	m.state = state
+	m.mutex.Unlock()
+}
+
+// Skeleton describes its scheduling in the module console command
+type describer interface {
+	describe() string
+}
+
+func (mgr *Manager) commandModule(args []string) string {
+	if len(args) > 0 {
+		for _, m := range mgr.mods {
+			if m.getName() != args[0] {
+				continue
+			}
+			if d, ok := m.mi.(describer); ok {
+				return strings.Replace(d.describe(), "\n", "\r\n", -1)
+			}
+			return ""
+		}
+		return "Usage: module [name]"
+	}
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "module\tstate\trestarts\tlast crash")
+	for _, m := range mgr.mods {
+		m.mutex.Lock()
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", m.getName(), m.state, len(m.restarts), m.lastCrash)
+		m.mutex.Unlock()
+	}
+	w.Flush()
+	return strings.Replace(strings.TrimSuffix(buf.String(), "\n"), "\n", "\r\n", -1)
+}
@@ -0,0 +1,188 @@
+package module
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shinjuwu/leaf/chanrpc"
+	"github.com/shinjuwu/leaf/console"
+)
+
+// the usual leaf module: a package level skeleton assigned in OnInit
+type crashModule struct {
+	*Skeleton
+	sk   *Skeleton
+	runs int32
+}
+
+func (m *crashModule) OnInit() {
+	m.Skeleton = m.sk
+	m.RegisterCommand("hello", "", func(args []interface{}) interface{} {
+		return "hello"
+	})
+}
+
+func (m *crashModule) OnDestroy() {}
+
+func (m *crashModule) Run(closeSig chan bool) {
+	if atomic.AddInt32(&m.runs, 1) == 1 {
+		panic("crash")
+	}
+	m.Skeleton.Run(closeSig)
+}
+
+func TestRestartSkeleton(t *testing.T) {
+	sk := &Skeleton{Name: "mod"}
+	sk.Init()
+	// registered in init()
+	sk.RegisterCommand("version", "", func(args []interface{}) interface{} {
+		return "1.0"
+	})
+
+	mgr := NewManager(console.New())
+	mgr.RestartPolicy = RestartPolicy{Mode: RestartAlways}
+	mi := &crashModule{sk: sk}
+	mgr.Register(mi)
+	if err := mgr.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := mgr.mods[0]
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.mutex.Lock()
+		state, restarts := m.state, len(m.restarts)
+		m.mutex.Unlock()
+		if state == stateRunning && restarts == 1 && atomic.LoadInt32(&mi.runs) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state %v, %v restarts", state, restarts)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for name, want := range map[string]string{"hello": "hello", "version": "1.0"} {
+		ret, err := sk.commandServer.Call1(name)
+		if err != nil || ret != want {
+			t.Errorf("command %v: %v %v, want %v", name, ret, err, want)
+		}
+	}
+	if len(sk.commands) != 2 {
+		t.Errorf("%v commands, want 2", len(sk.commands))
+	}
+
+	if err := mgr.Destroy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a handler of a running skeleton crashes the module, Run panics after
+// the skeleton is closed
+type liveModule struct {
+	*Skeleton
+	closeSig chan bool
+	crashed  bool
+	runs     int32
+}
+
+func (m *liveModule) OnInit()    {}
+func (m *liveModule) OnDestroy() {}
+
+func (m *liveModule) Run(closeSig chan bool) {
+	m.closeSig = closeSig
+	atomic.AddInt32(&m.runs, 1)
+	m.Skeleton.Run(closeSig)
+	if m.crashed {
+		m.crashed = false
+		panic("crash")
+	}
+}
+
+func TestRestartLiveSkeleton(t *testing.T) {
+	mi := &liveModule{
+		Skeleton: &Skeleton{
+			Name:               "live",
+			GoLen:              10,
+			TimerDispatcherLen: 10,
+			TimerTick:          time.Millisecond,
+			ChanRPCServer:      chanrpc.NewServer(10),
+		},
+	}
+	mi.Init()
+	mi.RegisterChanRPC("crash", func(args []interface{}) {
+		mi.crashed = true
+		mi.closeSig <- true
+	})
+	mi.RegisterChanRPC("add", func(args []interface{}) interface{} {
+		return args[0].(int) + args[1].(int)
+	})
+	// the timers and Go of the skeleton are rebuilt
+	done := make(chan string, 2)
+	mi.RegisterChanRPC("later", func(args []interface{}) {
+		mi.AfterFunc(time.Millisecond, func() {
+			done <- "timer"
+		})
+		mi.Go(func() {}, func() {
+			done <- "go"
+		})
+	})
+
+	mgr := NewManager(console.New())
+	mgr.RestartPolicy = RestartPolicy{Mode: RestartAlways}
+	mgr.Register(mi)
+	if err := mgr.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := mi.ChanRPCServer
+	if ret, err := server.Call1("add", 1, 2); err != nil || ret != 3 {
+		t.Fatalf("add: %v %v", ret, err)
+	}
+	if err := server.Call0("crash"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := mgr.mods[0]
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.mutex.Lock()
+		state, restarts, lastCrash := m.state, len(m.restarts), m.lastCrash
+		m.mutex.Unlock()
+		if state == stateRunning && restarts == 1 && atomic.LoadInt32(&mi.runs) == 2 {
+			if lastCrash != "panic: crash" {
+				t.Errorf("last crash %q", lastCrash)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state %v, %v restarts", state, restarts)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if ret, err := server.Call1("add", 3, 4); err != nil || ret != 7 {
+		t.Fatalf("add after the restart: %v %v", ret, err)
+	}
+	if err := server.Call0("later"); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case s := <-done:
+			got[s] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %v after the restart", got)
+		}
+	}
+
+	if err := mgr.Destroy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Call1("add", 1, 2); err == nil {
+		t.Fatal("call served after destroy")
+	}
+}
@@ -0,0 +1,174 @@
+package module
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/shinjuwu/leaf/log"
+)
+
+// the watchdog watches the items dispatched by Skeleton.Run
+// from another goroutine
+type watchdog struct {
+	name      string
+	threshold time.Duration
+	interval  time.Duration
+	goroutine []byte
+	closeSig  chan bool
+
+	mutex    sync.Mutex
+	kind     string
+	id       interface{}
+	begun    time.Time
+	mark     time.Time
+	active   bool
+	reported bool
+	busy     time.Duration
+	items    int
+	max      time.Duration
+}
+
+// must be called on the module goroutine
+func newWatchdog(name string, threshold time.Duration, interval time.Duration) *watchdog {
+	w := new(watchdog)
+	w.name = name
+	w.threshold = threshold
+	w.interval = interval
+	w.goroutine = goroutinePrefix()
+	w.closeSig = make(chan bool)
+	go w.run()
+	return w
+}
+
+func (w *watchdog) close() {
+	close(w.closeSig)
+}
+
+func (w *watchdog) begin(kind string, id interface{}) {
+	if w == nil {
+		return
+	}
+
+	now := time.Now()
+	w.mutex.Lock()
+	w.kind = kind
+	w.id = id
+	w.begun = now
+	w.mark = now
+	w.active = true
+	w.reported = false
+	w.mutex.Unlock()
+}
+
+func (w *watchdog) end() {
+	if w == nil {
+		return
+	}
+
+	now := time.Now()
+	w.mutex.Lock()
+	d := now.Sub(w.begun)
+	w.busy += now.Sub(w.mark)
+	w.items++
+	if d > w.max {
+		w.max = d
+	}
+	w.active = false
+	kind, id := w.kind, w.id
+	w.mutex.Unlock()
+
+	if w.threshold > 0 && d > w.threshold {
+		log.Error("module %v: %v %v took %v", w.name, kind, id, d)
+	}
+}
+
+func (w *watchdog) run() {
+	var check, report <-chan time.Time
+	if w.threshold > 0 {
+		t := time.NewTicker(w.threshold / 2)
+		defer t.Stop()
+		check = t.C
+	}
+	if w.interval > 0 {
+		t := time.NewTicker(w.interval)
+		defer t.Stop()
+		report = t.C
+	}
+
+	last := time.Now()
+	for {
+		select {
+		case <-w.closeSig:
+			return
+		case <-check:
+			w.check()
+		case now := <-report:
+			w.report(now.Sub(last))
+			last = now
+		}
+	}
+}
+
+// an item blocking the module goroutine is reported once with its stack
+func (w *watchdog) check() {
+	w.mutex.Lock()
+	d := time.Since(w.begun)
+	blocked := w.active && !w.reported && d > w.threshold
+	if blocked {
+		w.reported = true
+	}
+	kind, id := w.kind, w.id
+	w.mutex.Unlock()
+
+	if blocked {
+		log.Error("module %v: %v %v blocked for %v: %s", w.name, kind, id, d, goroutineStack(w.goroutine))
+	}
+}
+
+func (w *watchdog) report(wall time.Duration) {
+	now := time.Now()
+	w.mutex.Lock()
+	if w.active {
+		w.busy += now.Sub(w.mark)
+		w.mark = now
+	}
+	busy, items, max := w.busy, w.items, w.max
+	w.busy = 0
+	w.items = 0
+	w.max = 0
+	w.mutex.Unlock()
+
+	log.Release("module %v: loop saturation %.1f%%, %v items, max %v",
+		w.name, float64(busy)/float64(wall)*100, items, max)
+}
+
+// "goroutine N [" of the calling goroutine
+func goroutinePrefix() []byte {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	if i := bytes.IndexByte(buf, '['); i >= 0 {
+		buf = buf[:i+1]
+	}
+	return buf
+}
+
+func goroutineStack(prefix []byte) []byte {
+	buf := make([]byte, 65536)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(stack, prefix) {
+			return stack
+		}
+	}
+	return nil
+}
@@ -113,6 +113,12 @@ func (server *TCPServer) run() {
 	}
 }
 
+// stop accepting new connections, the established ones are kept
+func (server *TCPServer) CloseListener() {
+	server.ln.Close()
+	server.wgLn.Wait()
+}
+
 func (server *TCPServer) Close() {
 	server.ln.Close()
 	server.wgLn.Wait()
@@ -140,6 +140,11 @@ func (server *WSServer) Start() {
 	go httpServer.Serve(ln)
 }
 
+// stop accepting new connections, the established ones are kept
+func (server *WSServer) CloseListener() {
+	server.ln.Close()
+}
+
 func (server *WSServer) Close() {
 	server.ln.Close()
 
@@ -0,0 +1,71 @@
+package timer_test
+
+import (
+	"github.com/shinjuwu/leaf/timer"
+	"testing"
+	"time"
+)
+
+func benchmarkAfterFuncStop(b *testing.B, d *timer.Dispatcher) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		d.AfterFunc(time.Minute, func() {}).Stop()
+	}
+}
+
+func BenchmarkDispatcherAfterFuncStop(b *testing.B) {
+	benchmarkAfterFuncStop(b, timer.NewDispatcher(10))
+}
+
+func BenchmarkWheelDispatcherAfterFuncStop(b *testing.B) {
+	d := timer.NewWheelDispatcher(10, 10*time.Millisecond)
+	defer d.Close()
+	benchmarkAfterFuncStop(b, d)
+}
+
+// 10000 pending timers per iteration, e.g. one per player
+func benchmarkManyTimers(b *testing.B, d *timer.Dispatcher) {
+	b.ReportAllocs()
+	timers := make([]*timer.Timer, 10000)
+	for i := 0; i < b.N; i++ {
+		for j := range timers {
+			timers[j] = d.AfterFunc(time.Duration(j)*time.Millisecond+time.Minute, func() {})
+		}
+		for _, t := range timers {
+			t.Stop()
+		}
+	}
+}
+
+func BenchmarkDispatcherManyTimers(b *testing.B) {
+	benchmarkManyTimers(b, timer.NewDispatcher(10))
+}
+
+func BenchmarkWheelDispatcherManyTimers(b *testing.B) {
+	d := timer.NewWheelDispatcher(10, 10*time.Millisecond)
+	defer d.Close()
+	benchmarkManyTimers(b, d)
+}
+
+// the timers expire and are dispatched
+func benchmarkFire(b *testing.B, d *timer.Dispatcher) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 100; j++ {
+			d.AfterFunc(time.Millisecond, func() {})
+		}
+		for j := 0; j < 100; j++ {
+			(<-d.ChanTimer).Cb()
+		}
+	}
+}
+
+func BenchmarkDispatcherFire(b *testing.B) {
+	benchmarkFire(b, timer.NewDispatcher(100))
+}
+
+func BenchmarkWheelDispatcherFire(b *testing.B) {
+	d := timer.NewWheelDispatcher(100, time.Millisecond)
+	defer d.Close()
+	benchmarkFire(b, d)
+}
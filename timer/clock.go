@@ -0,0 +1,178 @@
+package timer
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// the time source of a dispatcher
+type Clock interface {
+	Now() time.Time
+	// f is called on another goroutine when d elapses
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+type ClockTimer interface {
+	// returns false if the timer already expired or was stopped
+	Stop() bool
+}
+
+type realClock struct{}
+
+// the clock of time package
+var RealClock Clock = realClock{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
+
+// a VirtualClock only moves when it is told to,
+// expired timers are called on the goroutine moving the clock
+// in the order of their deadlines
+type VirtualClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers virtualTimers
+	seq    uint64
+}
+
+func NewVirtualClock(now time.Time) *VirtualClock {
+	c := new(VirtualClock)
+	c.now = now
+	return c
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.seq++
+	t := &virtualTimer{c: c, when: c.now.Add(d), seq: c.seq, f: f, index: -1}
+	heap.Push(&c.timers, t)
+	return t
+}
+
+// the deadline of the next timer
+func (c *VirtualClock) Next() (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.timers) == 0 {
+		return time.Time{}, false
+	}
+	return c.timers[0].when, true
+}
+
+// the number of timers not expired
+func (c *VirtualClock) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.timers)
+}
+
+// Step moves the clock to the deadline of the next timer and calls it,
+// returns false if there is no timer
+func (c *VirtualClock) Step() bool {
+	c.mutex.Lock()
+	if len(c.timers) == 0 {
+		c.mutex.Unlock()
+		return false
+	}
+	t := heap.Pop(&c.timers).(*virtualTimer)
+	if t.when.After(c.now) {
+		c.now = t.when
+	}
+	c.mutex.Unlock()
+
+	t.f()
+	return true
+}
+
+// Advance moves the clock forward by d
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock to now, the timers expired by then are called.
+// the clock never moves backward
+func (c *VirtualClock) Set(now time.Time) {
+	for {
+		next, ok := c.Next()
+		if !ok || next.After(now) {
+			break
+		}
+		c.Step()
+	}
+
+	c.mutex.Lock()
+	if now.After(c.now) {
+		c.now = now
+	}
+	c.mutex.Unlock()
+}
+
+type virtualTimer struct {
+	c     *VirtualClock
+	when  time.Time
+	seq   uint64
+	f     func()
+	index int
+}
+
+func (t *virtualTimer) Stop() bool {
+	t.c.mutex.Lock()
+	defer t.c.mutex.Unlock()
+
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.c.timers, t.index)
+	return true
+}
+
+type virtualTimers []*virtualTimer
+
+func (ts virtualTimers) Len() int {
+	return len(ts)
+}
+
+func (ts virtualTimers) Less(i, j int) bool {
+	if ts[i].when.Equal(ts[j].when) {
+		return ts[i].seq < ts[j].seq
+	}
+	return ts[i].when.Before(ts[j].when)
+}
+
+func (ts virtualTimers) Swap(i, j int) {
+	ts[i], ts[j] = ts[j], ts[i]
+	ts[i].index = i
+	ts[j].index = j
+}
+
+func (ts *virtualTimers) Push(x interface{}) {
+	t := x.(*virtualTimer)
+	t.index = len(*ts)
+	*ts = append(*ts, t)
+}
+
+func (ts *virtualTimers) Pop() interface{} {
+	old := *ts
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*ts = old[:len(old)-1]
+	return t
+}
@@ -9,14 +9,25 @@ import (
 	"time"
 )
 
-// Field name   | Mandatory? | Allowed values | Allowed special characters
-// ----------   | ---------- | -------------- | --------------------------
-// Seconds      | No         | 0-59           | * / , -
-// Minutes      | Yes        | 0-59           | * / , -
-// Hours        | Yes        | 0-23           | * / , -
-// Day of month | Yes        | 1-31           | * / , -
-// Month        | Yes        | 1-12           | * / , -
-// Day of week  | Yes        | 0-6            | * / , -
+// Field name   | Mandatory? | Allowed values  | Allowed special characters
+// ----------   | ---------- | --------------  | --------------------------
+// Seconds      | No         | 0-59            | * / , -
+// Minutes      | Yes        | 0-59            | * / , -
+// Hours        | Yes        | 0-23            | * / , -
+// Day of month | Yes        | 1-31            | * / , - ? L W
+// Month        | Yes        | 1-12 or JAN-DEC | * / , -
+// Day of week  | Yes        | 0-6 or SUN-SAT  | * / , - ? L #
+//
+// L: the last day of the month, Saturday alone in day of week, or with a day
+// of week (5L) the last such day of the month. W: the weekday nearest to the
+// day (15W), LW the last weekday of the month. #: the nth day of week of the
+// month (FRI#2).
+// ?: same as *.
+//
+// predefined: @yearly (@annually), @monthly, @weekly, @daily (@midnight), @hourly.
+// a CRON_TZ=<zone> (or TZ=<zone>) prefix sets Location.
+// a time skipped by a DST change runs as late as the change, e.g. 02:30
+// runs at 03:30 when 02:00 becomes 03:00, midnight included
 type CronExpr struct {
 	sec   uint64
 	min   uint64
@@ -24,11 +35,63 @@ type CronExpr struct {
 	dom   uint64
 	month uint64
 	dow   uint64
+	// L and LW
+	lastDom        bool
+	lastWeekdayDom bool
+	// nW
+	nearestWeekday uint64
+	// nL
+	lastDow uint64
+	// n#k, bit k of nthDow[n]
+	nthDow [7]uint8
+	// the time zone of the fields, the zone of the time passed to Next if nil
+	Location *time.Location
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+var monthNames = map[string]int{
+	"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+	"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+}
+
+var dowNames = map[string]int{
+	"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
 }
 
 // goroutine safe
 func NewCronExpr(expr string) (cronExpr *CronExpr, err error) {
 	fields := strings.Fields(expr)
+
+	// time zone
+	var loc *time.Location
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "CRON_TZ=") || strings.HasPrefix(fields[0], "TZ=")) {
+		loc, err = time.LoadLocation(fields[0][strings.Index(fields[0], "=")+1:])
+		if err != nil {
+			err = fmt.Errorf("invalid expr %v: %v", expr, err)
+			return
+		}
+		fields = fields[1:]
+	}
+
+	// macro
+	if len(fields) == 1 && strings.HasPrefix(fields[0], "@") {
+		macro, ok := cronMacros[strings.ToLower(fields[0])]
+		if !ok {
+			err = fmt.Errorf("invalid expr %v: unknown macro %v", expr, fields[0])
+			return
+		}
+		fields = strings.Fields(macro)
+	}
+
 	if len(fields) != 5 && len(fields) != 6 {
 		err = fmt.Errorf("invalid expr %v: expected 5 or 6 fields, got %v", expr, len(fields))
 		return
@@ -39,33 +102,34 @@ func NewCronExpr(expr string) (cronExpr *CronExpr, err error) {
 	}
 
 	cronExpr = new(CronExpr)
+	cronExpr.Location = loc
 	// Seconds
-	cronExpr.sec, err = parseCronField(fields[0], 0, 59)
+	cronExpr.sec, err = parseCronField(fields[0], 0, 59, nil)
 	if err != nil {
 		goto onError
 	}
 	// Minutes
-	cronExpr.min, err = parseCronField(fields[1], 0, 59)
+	cronExpr.min, err = parseCronField(fields[1], 0, 59, nil)
 	if err != nil {
 		goto onError
 	}
 	// Hours
-	cronExpr.hour, err = parseCronField(fields[2], 0, 23)
+	cronExpr.hour, err = parseCronField(fields[2], 0, 23, nil)
 	if err != nil {
 		goto onError
 	}
 	// Day of month
-	cronExpr.dom, err = parseCronField(fields[3], 1, 31)
+	err = cronExpr.parseDom(fields[3])
 	if err != nil {
 		goto onError
 	}
 	// Month
-	cronExpr.month, err = parseCronField(fields[4], 1, 12)
+	cronExpr.month, err = parseCronField(fields[4], 1, 12, monthNames)
 	if err != nil {
 		goto onError
 	}
 	// Day of week
-	cronExpr.dow, err = parseCronField(fields[5], 0, 6)
+	err = cronExpr.parseDow(fields[5])
 	if err != nil {
 		goto onError
 	}
@@ -76,13 +140,97 @@ onError:
 	return
 }
 
+// L, LW and nW besides the common syntax
+func (e *CronExpr) parseDom(field string) error {
+	if field == "?" {
+		field = "*"
+	}
+
+	var common []string
+	for _, f := range strings.Split(field, ",") {
+		switch {
+		case f == "L":
+			e.lastDom = true
+		case f == "LW":
+			e.lastWeekdayDom = true
+		case strings.HasSuffix(f, "W"):
+			day, err := strconv.Atoi(strings.TrimSuffix(f, "W"))
+			if err != nil || day < 1 || day > 31 {
+				return fmt.Errorf("invalid weekday: %v", f)
+			}
+			e.nearestWeekday |= 1 << uint(day)
+		default:
+			common = append(common, f)
+		}
+	}
+
+	if len(common) > 0 {
+		var err error
+		e.dom, err = parseCronField(strings.Join(common, ","), 1, 31, nil)
+		return err
+	}
+	return nil
+}
+
+// nL and n#k besides the common syntax
+func (e *CronExpr) parseDow(field string) error {
+	if field == "?" {
+		field = "*"
+	}
+
+	var common []string
+	for _, f := range strings.Split(field, ",") {
+		switch {
+		case f == "L":
+			common = append(common, "6")
+		case strings.HasSuffix(f, "L"):
+			dow, err := parseCronValue(strings.TrimSuffix(f, "L"), dowNames)
+			if err != nil || dow < 0 || dow > 6 {
+				return fmt.Errorf("invalid last day of week: %v", f)
+			}
+			e.lastDow |= 1 << uint(dow)
+		case strings.Contains(f, "#"):
+			dowAndNth := strings.Split(f, "#")
+			if len(dowAndNth) != 2 {
+				return fmt.Errorf("invalid nth day of week: %v", f)
+			}
+			dow, err := parseCronValue(dowAndNth[0], dowNames)
+			if err != nil || dow < 0 || dow > 6 {
+				return fmt.Errorf("invalid nth day of week: %v", f)
+			}
+			nth, err := strconv.Atoi(dowAndNth[1])
+			if err != nil || nth < 1 || nth > 5 {
+				return fmt.Errorf("invalid nth day of week: %v", f)
+			}
+			e.nthDow[dow] |= 1 << uint(nth)
+		default:
+			common = append(common, f)
+		}
+	}
+
+	if len(common) > 0 {
+		var err error
+		e.dow, err = parseCronField(strings.Join(common, ","), 0, 6, dowNames)
+		return err
+	}
+	return nil
+}
+
+// a number or a name
+func parseCronValue(s string, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToUpper(s)]; ok {
+		return v, nil
+	}
+	return strconv.Atoi(s)
+}
+
 // 1. *
 // 2. num
 // 3. num-num
 // 4. */num
 // 5. num/num (means num-max/num)
 // 6. num-num/num
-func parseCronField(field string, min int, max int) (cronField uint64, err error) {
+func parseCronField(field string, min int, max int, names map[string]int) (cronField uint64, err error) {
 	fields := strings.Split(field, ",")
 	for _, field := range fields {
 		rangeAndIncr := strings.Split(field, "/")
@@ -108,7 +256,7 @@ func parseCronField(field string, min int, max int) (cronField uint64, err error
 			end = max
 		} else {
 			// start
-			start, err = strconv.Atoi(startAndEnd[0])
+			start, err = parseCronValue(startAndEnd[0], names)
 			if err != nil {
 				err = fmt.Errorf("invalid range: %v", rangeAndIncr[0])
 				return
@@ -121,7 +269,7 @@ func parseCronField(field string, min int, max int) (cronField uint64, err error
 					end = start
 				}
 			} else {
-				end, err = strconv.Atoi(startAndEnd[1])
+				end, err = parseCronValue(startAndEnd[1], names)
 				if err != nil {
 					err = fmt.Errorf("invalid range: %v", rangeAndIncr[0])
 					return
@@ -171,23 +319,120 @@ func parseCronField(field string, min int, max int) (cronField uint64, err error
 	return
 }
 
+func (e *CronExpr) matchDom(t time.Time) bool {
+	if 1<<uint(t.Day())&e.dom != 0 {
+		return true
+	}
+
+	last := daysIn(t.Year(), t.Month())
+	if e.lastDom && t.Day() == last {
+		return true
+	}
+	if e.lastWeekdayDom && t.Day() == nearestWeekday(t.Year(), t.Month(), last) {
+		return true
+	}
+	if e.nearestWeekday != 0 {
+		for day := t.Day() - 2; day <= t.Day()+2; day++ {
+			if day >= 1 && day <= last && 1<<uint(day)&e.nearestWeekday != 0 &&
+				nearestWeekday(t.Year(), t.Month(), day) == t.Day() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *CronExpr) matchDow(t time.Time) bool {
+	dow := t.Weekday()
+	if 1<<uint(dow)&e.dow != 0 {
+		return true
+	}
+
+	if 1<<uint(dow)&e.lastDow != 0 && t.Day()+7 > daysIn(t.Year(), t.Month()) {
+		return true
+	}
+	if 1<<uint((t.Day()-1)/7+1)&e.nthDow[dow] != 0 {
+		return true
+	}
+	return false
+}
+
 func (e *CronExpr) matchDay(t time.Time) bool {
+	domBlank := e.dom == 0xfffffffe && !e.lastDom && !e.lastWeekdayDom && e.nearestWeekday == 0
+	dowBlank := e.dow == 0x7f && e.lastDow == 0 && e.nthDow == [7]uint8{}
+
 	// day-of-month blank
-	if e.dom == 0xfffffffe {
-		return 1<<uint(t.Weekday())&e.dow != 0
+	if domBlank {
+		return e.matchDow(t)
 	}
 
 	// day-of-week blank
-	if e.dow == 0x7f {
-		return 1<<uint(t.Day())&e.dom != 0
+	if dowBlank {
+		return e.matchDom(t)
+	}
+
+	return e.matchDow(t) || e.matchDom(t)
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// the weekday nearest to the day, within the month
+func nearestWeekday(year int, month time.Month, day int) int {
+	switch time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Weekday() {
+	case time.Saturday:
+		if day == 1 {
+			return day + 2
+		}
+		return day - 1
+	case time.Sunday:
+		if day == daysIn(year, month) {
+			return day - 2
+		}
+		return day + 1
+	default:
+		return day
+	}
+}
+
+// the first instant of the day, midnight may be skipped by a DST change
+func dayStart(year int, month time.Month, day int, loc *time.Location) time.Time {
+	noon := time.Date(year, month, day, 12, 0, 0, 0, loc)
+	t := time.Date(noon.Year(), noon.Month(), noon.Day(), 0, 0, 0, 0, loc)
+	for t.Day() != noon.Day() {
+		t = t.Add(time.Hour)
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
 	}
+	return t
+}
 
-	return 1<<uint(t.Weekday())&e.dow != 0 ||
-		1<<uint(t.Day())&e.dom != 0
+// the hours skipped by a DST change match the first hour after it
+func (e *CronExpr) matchHour(t time.Time) bool {
+	if 1<<uint(t.Hour())&e.hour != 0 {
+		return true
+	}
+
+	// a DST change is an hour or half an hour
+	prev := t.Add(-time.Hour / 2)
+	from := 0
+	if prev.Day() == t.Day() {
+		from = prev.Hour() + 1
+	}
+	for h := from; h < t.Hour(); h++ {
+		if 1<<uint(h)&e.hour != 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // goroutine safe
 func (e *CronExpr) Next(t time.Time) time.Time {
+	if e.Location != nil {
+		t = t.In(e.Location)
+	}
+
 	// the upcoming second
 	t = t.Truncate(time.Second).Add(time.Second)
 
@@ -202,12 +447,8 @@ retry:
 
 	// Month
 	for 1<<uint(t.Month())&e.month == 0 {
-		if !initFlag {
-			initFlag = true
-			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
-		}
-
-		t = t.AddDate(0, 1, 0)
+		initFlag = true
+		t = dayStart(t.Year(), t.Month()+1, 1, t.Location())
 		if t.Month() == time.January {
 			goto retry
 		}
@@ -215,51 +456,52 @@ retry:
 
 	// Day
 	for !e.matchDay(t) {
-		if !initFlag {
-			initFlag = true
-			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
-		}
-
-		t = t.AddDate(0, 0, 1)
+		initFlag = true
+		t = dayStart(t.Year(), t.Month(), t.Day()+1, t.Location())
 		if t.Day() == 1 {
 			goto retry
 		}
 	}
 
 	// Hours
-	for 1<<uint(t.Hour())&e.hour == 0 {
+	day := t.Day()
+	for !e.matchHour(t) {
 		if !initFlag {
 			initFlag = true
-			t = t.Truncate(time.Hour)
+			// in Location, whose offset may not be whole hours
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
 		}
 
-		t = t.Add(time.Hour)
-		if t.Hour() == 0 {
+		// a DST change of half an hour leaves t in the middle of an hour
+		t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		if t.Day() != day {
 			goto retry
 		}
 	}
 
 	// Minutes
+	hour := t.Hour()
 	for 1<<uint(t.Minute())&e.min == 0 {
 		if !initFlag {
 			initFlag = true
-			t = t.Truncate(time.Minute)
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
 		}
 
 		t = t.Add(time.Minute)
-		if t.Minute() == 0 {
+		if t.Hour() != hour {
 			goto retry
 		}
 	}
 
 	// Seconds
+	min := t.Minute()
 	for 1<<uint(t.Second())&e.sec == 0 {
 		if !initFlag {
 			initFlag = true
 		}
 
 		t = t.Add(time.Second)
-		if t.Second() == 0 {
+		if t.Minute() != min {
 			goto retry
 		}
 	}
@@ -3,6 +3,9 @@ package timer_test
 import (
 	"fmt"
 	"github.com/shinjuwu/leaf/timer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -43,6 +46,68 @@ func ExampleCronExpr() {
 	// 2000-01-01 21:00:00 +0000 UTC
 }
 
+func ExampleNewCronExpr() {
+	for _, expr := range []string{
+		"0 0 12 * * MON-FRI",
+		"@daily",
+		"0 0 0 L * ?",
+		"0 0 0 ? * FRI#2",
+		"0 0 0 ? * 5L",
+		"0 0 9 ? * L",
+		"0 0 0 1W * ?",
+		"CRON_TZ=Asia/Tokyo 0 0 9 * * *",
+	} {
+		cronExpr, err := timer.NewCronExpr(expr)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		// Saturday
+		fmt.Println(cronExpr.Next(time.Date(
+			2000, 1, 1,
+			20, 10, 5,
+			0, time.UTC,
+		)).UTC())
+	}
+
+	// midnight of 2018-11-04 is skipped by DST in Sao Paulo
+	cronExpr, err := timer.NewCronExpr("CRON_TZ=America/Sao_Paulo 0 0 0 * * *")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(cronExpr.Next(time.Date(2018, 11, 3, 12, 0, 0, 0, cronExpr.Location)))
+
+	// Output:
+	// 2000-01-03 12:00:00 +0000 UTC
+	// 2000-01-02 00:00:00 +0000 UTC
+	// 2000-01-31 00:00:00 +0000 UTC
+	// 2000-01-14 00:00:00 +0000 UTC
+	// 2000-01-28 00:00:00 +0000 UTC
+	// 2000-01-08 09:00:00 +0000 UTC
+	// 2000-01-03 00:00:00 +0000 UTC
+	// 2000-01-02 00:00:00 +0000 UTC
+	// 2018-11-04 01:00:00 -0200 -02
+}
+
+func ExampleCronExpr_location() {
+	// +05:30
+	cronExpr, err := timer.NewCronExpr("CRON_TZ=Asia/Kolkata 0 0 9 * * *")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	t := time.Date(2000, 1, 1, 7, 10, 0, 0, cronExpr.Location)
+	fmt.Println(cronExpr.Next(t))
+	fmt.Println(cronExpr.Next(cronExpr.Next(t)))
+
+	// Output:
+	// 2000-01-01 09:00:00 +0530 IST
+	// 2000-01-02 09:00:00 +0530 IST
+}
+
 func ExampleCron() {
 	d := timer.NewDispatcher(10)
 
@@ -65,3 +130,253 @@ func ExampleCron() {
 	// Output:
 	// My name is Leaf
 }
+
+func ExampleVirtualClock() {
+	clock := timer.NewVirtualClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := timer.NewDispatcherWithClock(10, clock)
+
+	d.AfterFunc(2*time.Second, func() {
+		fmt.Println("2s", clock.Now().Format("15:04:05"))
+	})
+	d.AfterFunc(time.Second, func() {
+		fmt.Println("1s", clock.Now().Format("15:04:05"))
+	})
+
+	// cron expr
+	cronExpr, err := timer.NewCronExpr("0 * * * * *")
+	if err != nil {
+		return
+	}
+	d.CronFunc(cronExpr, func() {
+		fmt.Println("cron", clock.Now().Format("15:04:05"))
+	})
+
+	// step the clock for one minute and dispatch
+	end := clock.Now().Add(time.Minute)
+	for next, ok := clock.Next(); ok && !next.After(end); next, ok = clock.Next() {
+		clock.Step()
+		(<-d.ChanTimer).Cb()
+	}
+
+	// Output:
+	// 1s 00:00:01
+	// 2s 00:00:02
+	// cron 00:01:00
+}
+
+func ExampleWheelClock() {
+	// the dispatchers share the wheel
+	w := timer.NewWheelClock(time.Millisecond)
+	defer w.Close()
+
+	// nobody receives the timer of d1 for now
+	d1 := timer.NewDispatcherWithClock(0, w)
+	d2 := timer.NewDispatcherWithClock(1, w)
+	d1.AfterFunc(time.Millisecond, func() {})
+	d2.AfterFunc(5*time.Millisecond, func() {
+		fmt.Println("d2")
+	})
+
+	// the full ChanTimer of d1 does not block the wheel
+	select {
+	case t := <-d2.ChanTimer:
+		t.Cb()
+	case <-time.After(time.Second):
+		fmt.Println("stalled")
+	}
+	(<-d1.ChanTimer).Cb()
+
+	// Output:
+	// d2
+}
+
+func ExampleTimer_Pause() {
+	clock := timer.NewVirtualClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := timer.NewDispatcherWithClock(10, clock)
+
+	// a turn of 30 seconds, paused while the player is away
+	t := d.AfterFunc(30*time.Second, func() {
+		fmt.Println("turn over", clock.Now().Format("15:04:05"))
+	})
+	clock.Advance(10 * time.Second)
+	t.Pause()
+	clock.Advance(time.Minute)
+	fmt.Println(t.Remaining())
+	t.Resume()
+
+	// the expired timer is dispatched
+	clock.Advance(20 * time.Second)
+	(<-d.ChanTimer).Cb()
+
+	// reset, the queued shot of the old deadline is ignored
+	t.Reset(time.Second)
+	clock.Advance(time.Second)
+	t.Reset(time.Second)
+	(<-d.ChanTimer).Cb()
+	clock.Advance(time.Second)
+	(<-d.ChanTimer).Cb()
+
+	// Output:
+	// 20s
+	// turn over 00:01:30
+	// turn over 00:01:32
+}
+
+func ExampleTicker() {
+	clock := timer.NewVirtualClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := timer.NewDispatcherWithClock(10, clock)
+
+	for _, policy := range []timer.TickPolicy{timer.TickSkip, timer.TickCatchUp} {
+		n := 0
+		tk := d.TickerFunc(time.Second, policy, func() {
+			n++
+		})
+
+		// the goroutine is busy for 3 seconds
+		clock.Advance(3 * time.Second)
+		(<-d.ChanTimer).Cb()
+		tk.Stop()
+		fmt.Println(n)
+	}
+
+	// Output:
+	// 1
+	// 3
+}
+
+func ExampleScheduler() {
+	dir, err := ioutil.TempDir("", "leaf")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.json")
+
+	clock := timer.NewVirtualClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	newScheduler := func() (*timer.Dispatcher, *timer.Scheduler) {
+		d := timer.NewDispatcherWithClock(10, clock)
+		s := timer.NewScheduler(d, timer.NewFileStore(path))
+		s.Register("reward", func(job *timer.Job) {
+			fmt.Println("reward", string(job.Data), clock.Now().Format("15:04"))
+		})
+		s.Register("reset", func(job *timer.Job) {
+			fmt.Println("reset", clock.Now().Format("15:04"))
+		})
+		if err := s.Start(); err != nil {
+			fmt.Println(err)
+		}
+		return d, s
+	}
+
+	// schedule
+	_, s := newScheduler()
+	s.ScheduleAfter("reward:1", "reward", time.Hour, timer.MisfireRunOnce, []byte("player 1"))
+	s.ScheduleCron("reset", "reset", "0 * * * *", timer.MisfireRunAll, nil)
+
+	// the process is down for two and a half hours
+	clock.Advance(150 * time.Minute)
+
+	// restart
+	d, s := newScheduler()
+	clock.Advance(0)
+	for i := 0; i < 2; i++ {
+		(<-d.ChanTimer).Cb()
+	}
+	fmt.Println(len(s.Jobs()), s.Jobs()[0].At.Format("15:04"))
+
+	// Output:
+	// reset 02:30
+	// reset 02:30
+	// reward player 1 02:30
+	// 1 03:00
+}
+
+func ExampleScheduler_MisfireLimit() {
+	dir, err := ioutil.TempDir("", "leaf")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.json")
+
+	clock := timer.NewVirtualClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	ticks := 0
+	newScheduler := func() (*timer.Dispatcher, *timer.Scheduler) {
+		d := timer.NewDispatcherWithClock(10, clock)
+		s := timer.NewScheduler(d, timer.NewFileStore(path))
+		s.MisfireLimit = 3
+		s.Register("tick", func(job *timer.Job) {
+			ticks++
+		})
+		s.Register("reward", func(job *timer.Job) {
+			fmt.Println("reward", string(job.Data), clock.Now().Format("15:04:05"))
+		})
+		return d, s
+	}
+
+	_, s := newScheduler()
+	s.Start()
+	s.ScheduleCron("tick", "tick", "* * * * * *", timer.MisfireRunAll, nil)
+
+	// the process is down for an hour
+	clock.Advance(time.Hour)
+
+	// a job scheduled before Start keeps the stored ones
+	d, s := newScheduler()
+	s.ScheduleAfter("reward:1", "reward", time.Second, timer.MisfireRunOnce, []byte("player 1"))
+	s.Start()
+	clock.Advance(time.Second)
+	for i := 0; i < 2; i++ {
+		(<-d.ChanTimer).Cb()
+	}
+	fmt.Println(ticks)
+	for _, job := range s.Jobs() {
+		fmt.Println(job.ID, job.At.Format("15:04:05"))
+	}
+
+	// Output:
+	// reward player 1 01:00:01
+	// 3
+	// tick 01:00:02
+}
+
+func ExampleScheduler_Start() {
+	dir, err := ioutil.TempDir("", "leaf")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.json")
+
+	// a stored job of an invalid cron, e.g. edited by hand
+	data := `[
+		{"ID": "bad", "Name": "reset", "Cron": "0 0 25 * * *", "At": "2000-01-01T00:00:00Z"},
+		{"ID": "reset", "Name": "reset", "Cron": "0 * * * *", "At": "2000-01-01T01:00:00Z"}
+	]`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	clock := timer.NewVirtualClock(time.Date(2000, 1, 1, 0, 30, 0, 0, time.UTC))
+	d := timer.NewDispatcherWithClock(10, clock)
+	s := timer.NewScheduler(d, timer.NewFileStore(path))
+	s.Register("reset", func(job *timer.Job) {
+		fmt.Println(job.ID, clock.Now().Format("15:04"))
+	})
+	fmt.Println(s.Start())
+
+	clock.Advance(30 * time.Minute)
+	(<-d.ChanTimer).Cb()
+	for _, job := range s.Jobs() {
+		fmt.Println(job.ID, job.At.Format("15:04"))
+	}
+
+	// Output:
+	// <nil>
+	// reset 01:00
+	// reset 02:00
+}
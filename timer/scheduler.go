@@ -0,0 +1,375 @@
+package timer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shinjuwu/leaf/log"
+)
+
+// what a Scheduler does with the runs of a job missed during downtime
+type MisfirePolicy int
+
+const (
+	// the missed runs are dropped
+	MisfireSkip MisfirePolicy = iota
+	// one run for all the missed runs
+	MisfireRunOnce
+	// one run per missed run
+	MisfireRunAll
+)
+
+// a Job runs the function registered by Name at At,
+// and then by Cron if it is not empty
+type Job struct {
+	ID      string
+	Name    string
+	Cron    string
+	At      time.Time
+	Misfire MisfirePolicy
+	Data    []byte
+}
+
+// a JobStore keeps the jobs of a Scheduler across restarts
+type JobStore interface {
+	Load() ([]*Job, error)
+	Save(job *Job) error
+	Delete(id string) error
+}
+
+// a FileStore keeps the jobs in a JSON file, which is replaced atomically
+// on every change. the file is loaded by the first call. goroutine safe.
+// every Save and Delete writes and syncs the whole file, and a Scheduler
+// saves a cron job after each run, so the FileStore suits a few jobs run
+// minutes apart, not many jobs run every second
+type FileStore struct {
+	path  string
+	mutex sync.Mutex
+	jobs  map[string]*Job
+}
+
+func NewFileStore(path string) *FileStore {
+	fs := new(FileStore)
+	fs.path = path
+	return fs
+}
+
+func (fs *FileStore) Load() ([]*Job, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return fs.load()
+}
+
+func (fs *FileStore) load() ([]*Job, error) {
+	fs.jobs = make(map[string]*Job)
+	data, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*Job
+	err = json.Unmarshal(data, &jobs)
+	if err != nil {
+		fs.jobs = nil
+		return nil, fmt.Errorf("%v: %v", fs.path, err)
+	}
+	for _, job := range jobs {
+		fs.jobs[job.ID] = job
+	}
+	return jobs, nil
+}
+
+func (fs *FileStore) Save(job *Job) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.jobs == nil {
+		if _, err := fs.load(); err != nil {
+			return err
+		}
+	}
+	j := *job
+	fs.jobs[job.ID] = &j
+	return fs.write()
+}
+
+func (fs *FileStore) Delete(id string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.jobs == nil {
+		if _, err := fs.load(); err != nil {
+			return err
+		}
+	}
+	if _, ok := fs.jobs[id]; !ok {
+		return nil
+	}
+	delete(fs.jobs, id)
+	return fs.write()
+}
+
+func (fs *FileStore) write() error {
+	jobs := make([]*Job, 0, len(fs.jobs))
+	for _, job := range fs.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].ID < jobs[j].ID
+	})
+	data, err := json.MarshalIndent(jobs, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := fs.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fs.path)
+}
+
+// a Scheduler runs durable jobs on the goroutine of its dispatcher.
+// a job is removed from the store, or moved to its next run, after it runs,
+// so a job may run again if the process dies while it runs.
+// MisfireLimit: at most MisfireLimit missed runs of a job are counted,
+// 100 if 0, the others are dropped.
+// goroutine not safe
+type Scheduler struct {
+	MisfireLimit int
+	disp         *Dispatcher
+	store        JobStore
+	handlers     map[string]func(job *Job)
+	jobs         map[string]*scheduledJob
+}
+
+type scheduledJob struct {
+	job      *Job
+	cronExpr *CronExpr
+	t        *Timer
+}
+
+func NewScheduler(disp *Dispatcher, store JobStore) *Scheduler {
+	s := new(Scheduler)
+	s.disp = disp
+	s.store = store
+	s.handlers = make(map[string]func(job *Job))
+	s.jobs = make(map[string]*scheduledJob)
+	return s
+}
+
+// you must call the function before calling Start
+func (s *Scheduler) Register(name string, f func(job *Job)) {
+	if _, ok := s.handlers[name]; ok {
+		panic(fmt.Sprintf("job %v is already registered", name))
+	}
+
+	s.handlers[name] = f
+}
+
+// Start loads the stored jobs, the runs missed since they were stored
+// are handled by their misfire policies. a stored job of an invalid cron
+// is logged and skipped, it stays in the store.
+// the jobs scheduled before Start replace the stored ones of the same id
+func (s *Scheduler) Start() error {
+	jobs, err := s.store.Load()
+	if err != nil {
+		return err
+	}
+
+	limit := s.MisfireLimit
+	if limit <= 0 {
+		limit = 100
+	}
+	now := s.disp.clock.Now()
+	for _, job := range jobs {
+		if _, ok := s.jobs[job.ID]; ok {
+			continue
+		}
+
+		sj := &scheduledJob{job: job}
+		if job.Cron != "" {
+			sj.cronExpr, err = NewCronExpr(job.Cron)
+			if err != nil {
+				log.Error("job %v: %v", job.ID, err)
+				continue
+			}
+		}
+
+		if job.At.After(now) {
+			s.arm(sj)
+			continue
+		}
+
+		// misfire
+		missed := 1
+		if sj.cronExpr != nil {
+			at := job.At
+			for {
+				at = sj.cronExpr.Next(at)
+				if at.IsZero() || at.After(now) {
+					break
+				}
+				if missed == limit {
+					log.Error("job %v: more than %v runs missed, the others are dropped", job.ID, limit)
+					at = sj.cronExpr.Next(now)
+					break
+				}
+				missed++
+			}
+			job.At = at
+		}
+		switch job.Misfire {
+		case MisfireSkip:
+			missed = 0
+		case MisfireRunOnce:
+			missed = 1
+		}
+		s.misfire(sj, missed)
+	}
+	return nil
+}
+
+func (s *Scheduler) misfire(sj *scheduledJob, missed int) {
+	s.jobs[sj.job.ID] = sj
+	sj.t = s.disp.AfterFunc(0, func() {
+		for i := 0; i < missed; i++ {
+			s.run(sj.job)
+		}
+		s.next(sj)
+	})
+}
+
+func (s *Scheduler) ScheduleAt(id string, name string, at time.Time, misfire MisfirePolicy, data []byte) error {
+	return s.schedule(&scheduledJob{job: &Job{ID: id, Name: name, At: at, Misfire: misfire, Data: data}})
+}
+
+func (s *Scheduler) ScheduleAfter(id string, name string, d time.Duration, misfire MisfirePolicy, data []byte) error {
+	return s.ScheduleAt(id, name, s.disp.clock.Now().Add(d), misfire, data)
+}
+
+func (s *Scheduler) ScheduleCron(id string, name string, expr string, misfire MisfirePolicy, data []byte) error {
+	cronExpr, err := NewCronExpr(expr)
+	if err != nil {
+		return err
+	}
+	at := cronExpr.Next(s.disp.clock.Now())
+	if at.IsZero() {
+		return fmt.Errorf("job %v: %v never runs", id, expr)
+	}
+
+	return s.schedule(&scheduledJob{
+		job:      &Job{ID: id, Name: name, Cron: expr, At: at, Misfire: misfire, Data: data},
+		cronExpr: cronExpr,
+	})
+}
+
+// a job of the same id is replaced
+func (s *Scheduler) schedule(sj *scheduledJob) error {
+	if _, ok := s.handlers[sj.job.Name]; !ok {
+		return fmt.Errorf("job %v: %v is not registered", sj.job.ID, sj.job.Name)
+	}
+
+	err := s.store.Save(sj.job)
+	if err != nil {
+		return err
+	}
+	if old, ok := s.jobs[sj.job.ID]; ok {
+		old.t.Stop()
+	}
+	s.arm(sj)
+	return nil
+}
+
+func (s *Scheduler) Cancel(id string) error {
+	if sj, ok := s.jobs[id]; ok {
+		sj.t.Stop()
+		delete(s.jobs, id)
+	}
+	return s.store.Delete(id)
+}
+
+// the scheduled jobs sorted by their next runs
+func (s *Scheduler) Jobs() []Job {
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, sj := range s.jobs {
+		jobs = append(jobs, *sj.job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].At.Before(jobs[j].At)
+	})
+	return jobs
+}
+
+func (s *Scheduler) arm(sj *scheduledJob) {
+	s.jobs[sj.job.ID] = sj
+	sj.t = s.disp.AfterFunc(sj.job.At.Sub(s.disp.clock.Now()), func() {
+		s.run(sj.job)
+		s.next(sj)
+	})
+}
+
+func (s *Scheduler) run(job *Job) {
+	f := s.handlers[job.Name]
+	if f == nil {
+		log.Error("job %v: %v is not registered", job.ID, job.Name)
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("job %v: %v", job.ID, r)
+		}
+	}()
+	f(job)
+}
+
+// the job is moved to its next run or removed, a write of the store per run
+func (s *Scheduler) next(sj *scheduledJob) {
+	if s.jobs[sj.job.ID] != sj {
+		return
+	}
+
+	var err error
+	if sj.cronExpr != nil {
+		now := s.disp.clock.Now()
+		if !sj.job.At.After(now) {
+			sj.job.At = sj.cronExpr.Next(now)
+		}
+		if !sj.job.At.IsZero() {
+			err = s.store.Save(sj.job)
+			s.arm(sj)
+			if err != nil {
+				log.Error("job %v: %v", sj.job.ID, err)
+			}
+			return
+		}
+	}
+
+	delete(s.jobs, sj.job.ID)
+	err = s.store.Delete(sj.job.ID)
+	if err != nil {
+		log.Error("job %v: %v", sj.job.ID, err)
+	}
+}
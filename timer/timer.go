@@ -10,28 +10,158 @@ import (
 // one dispatcher per goroutine (goroutine not safe)
 type Dispatcher struct {
 	ChanTimer chan *Timer
+	clock     Clock
+	closeSig  chan bool
 }
 
 func NewDispatcher(l int) *Dispatcher {
+	return NewDispatcherWithClock(l, RealClock)
+}
+
+func NewDispatcherWithClock(l int, clock Clock) *Dispatcher {
 	disp := new(Dispatcher)
 	disp.ChanTimer = make(chan *Timer, l)
+	disp.clock = clock
+	disp.closeSig = make(chan bool)
 	return disp
 }
 
+func (disp *Dispatcher) Clock() Clock {
+	return disp.clock
+}
+
+// the clock of the dispatcher is closed if it has a goroutine,
+// e.g. a WheelClock. the timers fired later are dropped
+func (disp *Dispatcher) Close() {
+	close(disp.closeSig)
+	if c, ok := disp.clock.(interface {
+		Close()
+	}); ok {
+		c.Close()
+	}
+}
+
 // Timer
 type Timer struct {
-	t  *time.Timer
-	cb func()
+	t        ClockTimer
+	cb       func()
+	deadline time.Time
+	disp     *Dispatcher
+	// a re-armed timer is sent to ChanTimer as a new shot,
+	// the shots other than current are stale and ignored
+	owner     *Timer
+	current   *Timer
+	paused    bool
+	remaining time.Duration
+}
+
+// the time the timer is due, by the clock of its dispatcher
+func (t *Timer) Deadline() time.Time {
+	return t.deadline
 }
 
 func (t *Timer) Stop() {
-	t.t.Stop()
-	t.cb = nil
+	if t.current != nil {
+		t.current.t.Stop()
+		t.current = nil
+	}
+	t.paused = false
+}
+
+// the remaining time is kept until Resume
+func (t *Timer) Pause() {
+	if t.current == nil || t.paused {
+		return
+	}
+
+	t.remaining = t.Remaining()
+	t.Stop()
+	t.paused = true
+}
+
+func (t *Timer) Resume() {
+	if !t.paused {
+		return
+	}
+
+	t.paused = false
+	t.arm(t.remaining)
+}
+
+// the timer is due after d, whether it is stopped, paused or expired
+func (t *Timer) Reset(d time.Duration) {
+	t.Stop()
+	t.arm(d)
+}
+
+// 0 if the timer is stopped or expired
+func (t *Timer) Remaining() time.Duration {
+	if t.paused {
+		return t.remaining
+	}
+	if t.current == nil {
+		return 0
+	}
+
+	d := t.deadline.Sub(t.disp.clock.Now())
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+func (t *Timer) arm(d time.Duration) {
+	shot := t
+	if t.t != nil {
+		shot = &Timer{owner: t}
+	}
+
+	disp := t.disp
+	t.deadline = disp.clock.Now().Add(d)
+	shot.deadline = t.deadline
+	shot.t = disp.clock.AfterFunc(d, func() {
+		disp.fire(shot)
+	})
+	t.current = shot
+}
+
+// the clock may call f on its own goroutine, e.g. a WheelClock,
+// a full ChanTimer must not block it
+func (disp *Dispatcher) fire(shot *Timer) {
+	select {
+	case disp.ChanTimer <- shot:
+		return
+	default:
+	}
+
+	go func() {
+		select {
+		case disp.ChanTimer <- shot:
+		case <-disp.closeSig:
+		}
+	}()
+}
+
+// a stale shot was re-armed, stopped or already run, Cb ignores it
+func (t *Timer) Stale() bool {
+	owner := t
+	if t.owner != nil {
+		owner = t.owner
+	}
+	return owner.current != t
 }
 
 func (t *Timer) Cb() {
+	if t.Stale() {
+		return
+	}
+	owner := t
+	if t.owner != nil {
+		owner = t.owner
+	}
+	owner.current = nil
+
 	defer func() {
-		t.cb = nil
 		if r := recover(); r != nil {
 			if conf.LenStackBuf > 0 {
 				buf := make([]byte, conf.LenStackBuf)
@@ -43,17 +173,16 @@ func (t *Timer) Cb() {
 		}
 	}()
 
-	if t.cb != nil {
-		t.cb()
+	if owner.cb != nil {
+		owner.cb()
 	}
 }
 
 func (disp *Dispatcher) AfterFunc(d time.Duration, cb func()) *Timer {
 	t := new(Timer)
 	t.cb = cb
-	t.t = time.AfterFunc(d, func() {
-		disp.ChanTimer <- t
-	})
+	t.disp = disp
+	t.arm(d)
 	return t
 }
 
@@ -71,7 +200,7 @@ func (c *Cron) Stop() {
 func (disp *Dispatcher) CronFunc(cronExpr *CronExpr, _cb func()) *Cron {
 	c := new(Cron)
 
-	now := time.Now()
+	now := disp.clock.Now()
 	nextTime := cronExpr.Next(now)
 	if nextTime.IsZero() {
 		return c
@@ -82,7 +211,7 @@ func (disp *Dispatcher) CronFunc(cronExpr *CronExpr, _cb func()) *Cron {
 	cb = func() {
 		defer _cb()
 
-		now := time.Now()
+		now := disp.clock.Now()
 		nextTime := cronExpr.Next(now)
 		if nextTime.IsZero() {
 			return
@@ -93,3 +222,69 @@ func (disp *Dispatcher) CronFunc(cronExpr *CronExpr, _cb func()) *Cron {
 	c.t = disp.AfterFunc(nextTime.Sub(now), cb)
 	return c
 }
+
+// what a Ticker does with the ticks missed while the goroutine was busy
+type TickPolicy int
+
+const (
+	// one callback for the missed ticks
+	TickSkip TickPolicy = iota
+	// one callback per missed tick
+	TickCatchUp
+)
+
+// Ticker
+type Ticker struct {
+	t      *Timer
+	period time.Duration
+	policy TickPolicy
+	next   time.Time
+}
+
+func (disp *Dispatcher) TickerFunc(d time.Duration, policy TickPolicy, cb func()) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for TickerFunc")
+	}
+
+	tk := new(Ticker)
+	tk.period = d
+	tk.policy = policy
+	tk.next = disp.clock.Now().Add(d)
+	tk.t = disp.AfterFunc(d, func() {
+		now := disp.clock.Now()
+		n := 1
+		tk.next = tk.next.Add(tk.period)
+		for !tk.next.After(now) {
+			tk.next = tk.next.Add(tk.period)
+			n++
+		}
+		if tk.policy == TickSkip {
+			n = 1
+		}
+
+		// cb may stop the ticker
+		tk.t.Reset(tk.next.Sub(now))
+		for i := 0; i < n && tk.t.current != nil; i++ {
+			cb()
+		}
+	})
+	return tk
+}
+
+func (tk *Ticker) Stop() {
+	tk.t.Stop()
+}
+
+func (tk *Ticker) Pause() {
+	tk.t.Pause()
+}
+
+// the ticks are counted from the resumption
+func (tk *Ticker) Resume() {
+	if !tk.t.paused {
+		return
+	}
+
+	tk.next = tk.t.disp.clock.Now().Add(tk.t.remaining)
+	tk.t.Resume()
+}
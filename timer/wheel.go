@@ -0,0 +1,189 @@
+package timer
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	wheelBits   = 6
+	wheelSize   = 1 << wheelBits
+	wheelMask   = wheelSize - 1
+	wheelLevels = 5
+)
+
+// a WheelClock keeps its timers in a hierarchical timing wheel,
+// a timer expires on the first tick at or after its deadline.
+// the timers are called on the goroutine of the wheel
+type WheelClock struct {
+	tick     time.Duration
+	start    time.Time
+	mutex    sync.Mutex
+	current  int64
+	levels   [wheelLevels][wheelSize]wheelTimer
+	closeSig chan bool
+}
+
+// a wheelTimer is also the sentinel of a slot list
+type wheelTimer struct {
+	w          *WheelClock
+	when       int64
+	f          func()
+	prev, next *wheelTimer
+}
+
+func NewWheelClock(tick time.Duration) *WheelClock {
+	if tick <= 0 {
+		tick = time.Millisecond
+	}
+
+	w := new(WheelClock)
+	w.tick = tick
+	w.start = time.Now()
+	for i := range w.levels {
+		for j := range w.levels[i] {
+			slot := &w.levels[i][j]
+			slot.prev = slot
+			slot.next = slot
+		}
+	}
+	w.closeSig = make(chan bool)
+	go w.run()
+	return w
+}
+
+func NewWheelDispatcher(l int, tick time.Duration) *Dispatcher {
+	return NewDispatcherWithClock(l, NewWheelClock(tick))
+}
+
+func (w *WheelClock) Now() time.Time {
+	return time.Now()
+}
+
+func (w *WheelClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	t := new(wheelTimer)
+	t.w = w
+	t.f = f
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// round up to the tick, the elapsed part of the current tick counts
+	now := int64(time.Since(w.start) / w.tick)
+	if now < w.current {
+		now = w.current
+	}
+	ticks := int64((d + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	t.when = now + ticks
+	w.add(t)
+	return t
+}
+
+// the ticker goroutine stops
+func (w *WheelClock) Close() {
+	close(w.closeSig)
+}
+
+func (w *WheelClock) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.closeSig:
+			return
+		case now := <-ticker.C:
+			w.advance(int64(now.Sub(w.start) / w.tick))
+		}
+	}
+}
+
+func (w *WheelClock) advance(target int64) {
+	for {
+		w.mutex.Lock()
+		if w.current >= target {
+			w.mutex.Unlock()
+			return
+		}
+		w.current++
+		w.cascade()
+
+		// detach the expired timers
+		slot := &w.levels[0][w.current&wheelMask]
+		var expired []func()
+		for t := slot.next; t != slot; {
+			next := t.next
+			t.prev, t.next = nil, nil
+			expired = append(expired, t.f)
+			t = next
+		}
+		slot.prev = slot
+		slot.next = slot
+		w.mutex.Unlock()
+
+		for _, f := range expired {
+			f()
+		}
+	}
+}
+
+// the timers of an upper level slot move down when the lower level wraps
+func (w *WheelClock) cascade() {
+	for level := 1; level < wheelLevels; level++ {
+		if (w.current>>(uint(level-1)*wheelBits))&wheelMask != 0 {
+			return
+		}
+
+		slot := &w.levels[level][(w.current>>(uint(level)*wheelBits))&wheelMask]
+		t := slot.next
+		slot.prev = slot
+		slot.next = slot
+		for t != slot {
+			next := t.next
+			w.add(t)
+			t = next
+		}
+	}
+}
+
+func (w *WheelClock) add(t *wheelTimer) {
+	// a timer due now is cascaded before the current slot fires
+	delta := t.when - w.current
+	if delta < 0 {
+		delta = 0
+	}
+
+	// too far timers wait in the last slot reachable and cascade again
+	max := int64(1)<<(wheelLevels*wheelBits) - 1
+	if delta > max {
+		delta = max
+	}
+
+	level := 0
+	for delta >= int64(1)<<(uint(level+1)*wheelBits) {
+		level++
+	}
+	when := w.current + delta
+	slot := &w.levels[level][(when>>(uint(level)*wheelBits))&wheelMask]
+
+	t.prev = slot.prev
+	t.next = slot
+	slot.prev.next = t
+	slot.prev = t
+}
+
+func (t *wheelTimer) Stop() bool {
+	t.w.mutex.Lock()
+	defer t.w.mutex.Unlock()
+
+	if t.next == nil {
+		return false
+	}
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev, t.next = nil, nil
+	return true
+}